@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"numskull/parser"
+	"numskull/token"
+)
+
+//Bytecode files start with this
+const bytecodeMagic string = "NSKB"
+
+//Version of the bytecode layout, changes whenever older files can't be read anymore
+const bytecodeVersion uint32 = 1
+
+//Is this file bytecode made by "numskull build"?
+func isBytecode(file []byte) bool {
+	return bytes.HasPrefix(file, []byte(bytecodeMagic))
+}
+
+//Write a parsed program as bytecode.
+//The layout is the magic, the version and the program length as u32le,
+//then every program value as f64le, then the source line of every value as u32le.
+func writeBytecode(w io.Writer, code []float64, lines []int) error {
+	raw := make([]byte, 12+len(code)*12)
+	copy(raw, bytecodeMagic)
+	binary.LittleEndian.PutUint32(raw[4:], bytecodeVersion)
+	binary.LittleEndian.PutUint32(raw[8:], uint32(len(code)))
+	pos := 12
+	for _, val := range code {
+		binary.LittleEndian.PutUint64(raw[pos:], math.Float64bits(val))
+		pos += 8
+	}
+	for _, line := range lines {
+		binary.LittleEndian.PutUint32(raw[pos:], uint32(line))
+		pos += 4
+	}
+	_, err := w.Write(raw)
+	return err
+}
+
+//Read bytecode written by writeBytecode
+func readBytecode(file []byte) ([]float64, []int, error) {
+	if !isBytecode(file) || len(file) < 12 {
+		return nil, nil, errors.New("not a bytecode file")
+	}
+	if version := binary.LittleEndian.Uint32(file[4:]); version != bytecodeVersion {
+		return nil, nil, fmt.Errorf("bytecode version %d is not supported, rebuild the program", version)
+	}
+	count := int(binary.LittleEndian.Uint32(file[8:]))
+	if len(file) != 12+count*12 {
+		return nil, nil, fmt.Errorf("bytecode is %d bytes, expected %d for %d values", len(file), 12+count*12, count)
+	}
+
+	//Program, then lines
+	code := make([]float64, count)
+	lines := make([]int, count)
+	raw := file[12:]
+	for i := range code {
+		code[i] = math.Float64frombits(binary.LittleEndian.Uint64(raw[i*8:]))
+	}
+	raw = raw[count*8:]
+	for i := range lines {
+		lines[i] = int(binary.LittleEndian.Uint32(raw[i*4:]))
+	}
+
+	//Every instruction must be complete, so running it can't read past the end
+	starts := map[int]bool{len(code): true}
+	targets := make([]int, 0, 64)
+	for pos := 0; pos < len(code); {
+		next, target, ok := instructionEnd(code, pos)
+		if !ok {
+			return nil, nil, fmt.Errorf("bytecode has an invalid instruction at %d", pos)
+		}
+		starts[pos] = true
+		if target >= 0 {
+			targets = append(targets, target)
+		}
+		pos = next
+	}
+
+	//And jumps must land on an instruction, or the end of the program
+	for _, target := range targets {
+		if !starts[target] {
+			return nil, nil, fmt.Errorf("bytecode jumps to %d, which isn't the start of an instruction", target)
+		}
+	}
+	return code, lines, nil
+}
+
+//Like nextInstruction, but checks that the instruction is known, fits in the program
+//and only jumps to places inside it.
+//Also returns where the instruction jumps to, or -1 if it doesn't.
+func instructionEnd(code []float64, pos int) (int, int, bool) {
+	at := func(pos int) token.Token {
+		if pos >= len(code) {
+			return token.Invalid
+		}
+		return token.Token(code[pos])
+	}
+	jumps := func(pos int) (int, bool) {
+		if pos < len(code) && code[pos] >= 0 && code[pos] <= float64(len(code)) && code[pos] == math.Trunc(code[pos]) {
+			return int(code[pos]), true
+		}
+		return 0, false
+	}
+
+	switch at(pos) {
+	case token.FunctionEnd, token.Return:
+		return pos + 1, -1, true
+	case token.FunctionStart, token.SquareEnd, token.Else, token.Break, token.Continue:
+		target, ok := jumps(pos + 1)
+		return pos + 2, target, ok
+	}
+
+	//Number and chain, returns the position after them
+	number := func(pos int) (int, bool) {
+		if at(pos) != token.Number || pos+2 > len(code) {
+			return 0, false
+		}
+		pos += 2
+		for isChain(at(pos)) {
+			if at(pos+1) != token.Number || pos+3 > len(code) {
+				return 0, false
+			}
+			pos += 3
+		}
+		return pos, true
+	}
+
+	//Lefthand
+	pos, ok := number(pos)
+	if !ok {
+		return 0, 0, false
+	}
+
+	//Operation and operands
+	switch at(pos) {
+	case token.Decrement, token.Increment, token.Floor, token.Ceil, token.Round, token.Abs, token.Negate, token.Sqrt, token.PrintChar, token.PrintNumber, token.ReadInput, token.FunctionRun:
+		return pos + 1, -1, true
+	case token.Assign, token.Add, token.Sub, token.Multiply, token.Divide, token.FloorDivide, token.Modulo, token.Power,
+		token.BitAnd, token.BitOr, token.BitXor, token.ShiftLeft, token.ShiftRight:
+		end, ok := number(pos + 1)
+		return end, -1, ok
+	case token.Equals, token.Different, token.LessThan, token.LessEquals, token.GreaterThan, token.GreaterEquals:
+		end, ok := number(pos + 1)
+		if !ok {
+			return 0, 0, false
+		}
+		target, ok := jumps(end)
+		return end + 1, target, ok
+	}
+	return 0, 0, false
+}
+
+//Entrypoint for "numskull build"
+func buildCommand() *command {
+	outPath := ""
+
+	cmd := &command{
+		name:    "build",
+		args:    "<program-file>",
+		summary: "Save a program as bytecode",
+		details: []string{
+			"Bytecode skips parsing, and can be run and disassembled like source code.",
+			"Source lines are kept, so errors still point at the right line.",
+			"Without -o, the bytecode is saved next to the program, with the extension .nsb.",
+		},
+		flags: []*flagDef{
+			{name: "output", short: "o", value: "<path>", usage: "File to save the bytecode to", set: setString(&outPath)},
+		},
+	}
+	cmd.run = func(args []string) int {
+		if len(args) != 1 {
+			fmt.Fprintln(errorOutput, "Error: expected one program file")
+			fmt.Fprintln(errorOutput, "Run \"numskull help build\" for usage.")
+			return exitUsage
+		}
+		src, err := os.ReadFile(args[0])
+		if err != nil {
+			fmt.Fprintln(errorOutput, "Error opening program file")
+			fmt.Fprintln(errorOutput, err.Error())
+			return exitError
+		}
+
+		//Parse
+		parsed, diagnostics := parser.Parse(src)
+		for _, d := range diagnostics {
+			fmt.Fprintln(errorOutput, d.Error())
+		}
+		if len(diagnostics) != 0 {
+			return exitParse
+		}
+
+		//Save
+		if outPath == "" {
+			outPath = strings.TrimSuffix(args[0], ".nms") + ".nsb"
+		}
+		file, err := os.Create(outPath)
+		if err == nil {
+			err = writeBytecode(file, parsed.Code, parsed.Lines)
+			if cerr := file.Close(); err == nil {
+				err = cerr
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(errorOutput, "Error writing bytecode")
+			fmt.Fprintln(errorOutput, err.Error())
+			return exitError
+		}
+		return exitOK
+	}
+	return cmd
+}
+
+//Entrypoint for "numskull disasm"
+func disasmCommand() *command {
+	cmd := &command{
+		name:    "disasm",
+		args:    "<program-file>",
+		summary: "List the instructions of a program",
+		details: []string{
+			"Works on source code and bytecode.",
+			"Every row holds the program offset, the source line and the instruction.",
+			"Conditions, loops and functions show the offset they jump to.",
+		},
+	}
+	cmd.run = func(args []string) int {
+		if len(args) != 1 {
+			fmt.Fprintln(errorOutput, "Error: expected one program file")
+			fmt.Fprintln(errorOutput, "Run \"numskull help disasm\" for usage.")
+			return exitUsage
+		}
+		if status := loadProgram(args[0]); status != exitOK {
+			return status
+		}
+		disassemble(os.Stdout, program)
+		return exitOK
+	}
+	return cmd
+}
+
+//Write every instruction of a program, one per row
+func disassemble(w io.Writer, code []float64) {
+	for pos := 0; pos < len(code); pos = nextInstruction(code, pos) {
+		fmt.Fprintf(w, "%6d  line %-4d %s\n", pos, lineAt(pos), describeInstruction(code, pos))
+	}
+}
+
+//Instruction at pos, written the way it looks in source code
+func describeInstruction(code []float64, pos int) string {
+	tok := token.Token(code[pos])
+	switch tok {
+	case token.FunctionEnd, token.Return:
+		return tok.GetTokenName()
+	case token.FunctionStart, token.SquareEnd, token.Else, token.Break, token.Continue:
+		return fmt.Sprintf("%s jump %d", tok.GetTokenName(), int(code[pos+1]))
+	}
+
+	//Lefthand
+	text, pos := describeNumber(code, pos)
+
+	//Operation and operands
+	op := token.Token(code[pos])
+	switch op {
+	case token.Assign, token.Add, token.Sub, token.Multiply, token.Divide, token.FloorDivide, token.Modulo, token.Power,
+		token.BitAnd, token.BitOr, token.BitXor, token.ShiftLeft, token.ShiftRight:
+		righthand, _ := describeNumber(code, pos+1)
+		return fmt.Sprintf("%s %s %s", text, op.GetTokenName(), righthand)
+	case token.Equals, token.Different, token.LessThan, token.LessEquals, token.GreaterThan, token.GreaterEquals:
+		righthand, end := describeNumber(code, pos+1)
+		return fmt.Sprintf("%s %s %s jump %d", text, op.GetTokenName(), righthand, int(code[end]))
+	}
+	return text + op.GetTokenName()
+}
+
+//Number at pos and its chain, and the position after them
+func describeNumber(code []float64, pos int) (string, int) {
+	text := formatTraceNumber(code[pos+1])
+	pos += 2
+	for pos < len(code) && isChain(token.Token(code[pos])) {
+		chain := token.Token(code[pos]).GetTokenName()
+		if chain == "-" || code[pos+2] < 0 {
+			chain = " " + chain + " "
+		}
+		text += chain + formatTraceNumber(code[pos+2])
+		pos += 3
+	}
+	return text, pos
+}
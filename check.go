@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"numskull/parser"
+)
+
+//Entrypoint for "numskull check"
+func checkCommand() *command {
+	cmd := &command{
+		name:    "check",
+		args:    "<program-file...>",
+		summary: "Report errors in programs without running them",
+		details: []string{
+			"Every error is listed, starting with the path of the program.",
+			"Exits with status 3 if any program contains errors.",
+		},
+	}
+	cmd.run = func(paths []string) int {
+		if len(paths) == 0 {
+			fmt.Fprintln(errorOutput, "Error: expected at least one program file")
+			fmt.Fprintln(errorOutput, "Run \"numskull help check\" for usage.")
+			return exitUsage
+		}
+
+		status := exitOK
+		for _, path := range paths {
+			src, err := os.ReadFile(path)
+			if err != nil {
+				fmt.Fprintln(errorOutput, "Error opening program file")
+				fmt.Fprintln(errorOutput, err.Error())
+				status = exitError
+				continue
+			}
+			_, diagnostics := parser.Parse(src)
+			for _, d := range diagnostics {
+				fmt.Fprintf(errorOutput, "%s: %s\n", path, d.Error())
+			}
+			if len(diagnostics) != 0 {
+				status = exitParse
+			}
+		}
+		return status
+	}
+	return cmd
+}
+
+//Entrypoint for "numskull fmt"
+func fmtCommand() *command {
+	write := false
+	list := false
+
+	cmd := &command{
+		name:    "fmt",
+		args:    "<program-file...>",
+		summary: "Format programs",
+		details: []string{
+			"Lines are indented by 4 spaces for every open bracket.",
+			"Operations are spaced out, like 0+1 = 5 and 3#, and numbers are kept the way they're written.",
+			"Comments after code stay in the same column, and lines with block comments are left alone.",
+			"Programs containing errors are not formatted.",
+			"Without flags, the formatted program is printed.",
+		},
+		flags: []*flagDef{
+			{name: "write", short: "w", usage: "Write the result back to the file, instead of printing it", set: setTrue(&write)},
+			{name: "list", short: "l", usage: "List files whose formatting differs", set: setTrue(&list)},
+		},
+	}
+	cmd.run = func(paths []string) int {
+		if len(paths) == 0 {
+			fmt.Fprintln(errorOutput, "Error: expected at least one program file")
+			fmt.Fprintln(errorOutput, "Run \"numskull help fmt\" for usage.")
+			return exitUsage
+		}
+
+		status := exitOK
+		for _, path := range paths {
+			src, err := os.ReadFile(path)
+			if err != nil {
+				fmt.Fprintln(errorOutput, "Error opening program file")
+				fmt.Fprintln(errorOutput, err.Error())
+				status = exitError
+				continue
+			}
+
+			//Format it
+			formatted, diagnostics := parser.Format(src)
+			if len(diagnostics) != 0 {
+				for _, d := range diagnostics {
+					fmt.Fprintf(errorOutput, "%s: %s\n", path, d.Error())
+				}
+				status = exitParse
+				continue
+			}
+
+			//Output
+			changed := !bytes.Equal(src, formatted)
+			if list && changed {
+				fmt.Println(path)
+			}
+			if write {
+				if changed {
+					if err := os.WriteFile(path, formatted, 0644); err != nil {
+						fmt.Fprintln(errorOutput, "Error writing program file")
+						fmt.Fprintln(errorOutput, err.Error())
+						status = exitError
+					}
+				}
+			} else if !list {
+				os.Stdout.Write(formatted)
+			}
+		}
+		return status
+	}
+	return cmd
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//Process exit codes
+const (
+	exitOK    int = 0
+	exitError int = 1
+	exitUsage int = 2
+	exitParse int = 3
+	exitLimit int = 4
+)
+
+//A command line flag
+type flagDef struct {
+	name    string
+	short   string
+	value   string
+	usage   string
+	details []string
+	set     func(value string) error
+}
+
+//A command, like "numskull run"
+type command struct {
+	name    string
+	args    string
+	summary string
+	details []string
+	flags   []*flagDef
+	run     func(args []string) int
+}
+
+//Every command, in the order they're listed
+func allCommands() []*command {
+	return []*command{
+		runCommand(),
+		checkCommand(),
+		fmtCommand(),
+		buildCommand(),
+		disasmCommand(),
+		testCommand(),
+		coverCommand(),
+		replCommand(),
+		versionCommand(),
+		helpCommand(),
+	}
+}
+
+//Find a command by name
+func findCommand(name string) *command {
+	for _, cmd := range allCommands() {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+//Reads the command line, returns the exit code
+func runCLI(args []string) int {
+
+	//No arguments provided
+	if len(args) == 0 {
+		printUsage(errorOutput)
+		return exitUsage
+	}
+
+	//Help and version, the way older versions took them
+	switch args[0] {
+	case "-h", "--help":
+		return helpCommand().execute(args[1:])
+	case "-v", "--version":
+		return versionCommand().execute(args[1:])
+	}
+
+	//Commands
+	if cmd := findCommand(args[0]); cmd != nil {
+		return cmd.execute(args[1:])
+	}
+
+	//Without a command, it's a run
+	return runCommand().execute(args)
+}
+
+//Read flags and run the command
+func (cmd *command) execute(args []string) int {
+
+	//Help
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if arg == "-h" || arg == "--help" {
+			cmd.printHelp(os.Stdout)
+			return exitOK
+		}
+	}
+
+	//Flags
+	rest, err := cmd.parse(args)
+	if err != nil {
+		fmt.Fprintln(errorOutput, "Error: "+err.Error())
+		fmt.Fprintf(errorOutput, "Run \"numskull help %s\" for usage.\n", cmd.name)
+		return exitUsage
+	}
+	return cmd.run(rest)
+}
+
+//Read flags, and return the other arguments.
+//Flags look like -f value, -f=value, --flag value or --flag=value, and can be mixed with other arguments.
+//Everything after "--" is an argument, and so is "-".
+func (cmd *command) parse(args []string) ([]string, error) {
+	rest := make([]string, 0, len(args))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			rest = append(rest, args[i+1:]...)
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			rest = append(rest, arg)
+			continue
+		}
+
+		//Find flag
+		name, value, hasValue := strings.Cut(strings.TrimPrefix(arg[1:], "-"), "=")
+		flag := cmd.lookup(name)
+		if flag == nil {
+			return nil, fmt.Errorf("unknown flag '%s'", strings.SplitN(arg, "=", 2)[0])
+		}
+
+		//Get value
+		if flag.value == "" {
+			if hasValue {
+				return nil, fmt.Errorf("flag --%s doesn't take a value", flag.name)
+			}
+		} else if !hasValue {
+			i++
+			if i == len(args) {
+				return nil, fmt.Errorf("flag --%s needs a %s", flag.name, strings.Trim(flag.value, "<>"))
+			}
+			value = args[i]
+		}
+
+		//Set it
+		if err := flag.set(value); err != nil {
+			return nil, fmt.Errorf("--%s: %s", flag.name, err.Error())
+		}
+	}
+	return rest, nil
+}
+
+//Find a flag by its name or short name
+func (cmd *command) lookup(name string) *flagDef {
+	for _, flag := range cmd.flags {
+		if name == flag.name || (flag.short != "" && name == flag.short) {
+			return flag
+		}
+	}
+	return nil
+}
+
+//Flag as shown in usage, like "-i, --input <path>"
+func (flag *flagDef) label() string {
+	label := "--" + flag.name
+	if flag.short != "" {
+		label = "-" + flag.short + ", " + label
+	}
+	if flag.value != "" {
+		label += " " + flag.value
+	}
+	return label
+}
+
+//Prints usage of a command, generated from its flags
+func (cmd *command) printHelp(w io.Writer) {
+	usage := "Usage: numskull " + cmd.name
+	if len(cmd.flags) != 0 {
+		usage += " [flags]"
+	}
+	if cmd.args != "" {
+		usage += " " + cmd.args
+	}
+	fmt.Fprintln(w, usage)
+	fmt.Fprintln(w, cmd.summary+".")
+	for _, line := range cmd.details {
+		fmt.Fprintln(w, line)
+	}
+
+	//List flags, lined up
+	if len(cmd.flags) == 0 {
+		return
+	}
+	width := 0
+	for _, flag := range cmd.flags {
+		if len(flag.label()) > width {
+			width = len(flag.label())
+		}
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Flags:")
+	for _, flag := range cmd.flags {
+		fmt.Fprintf(w, "\t%-*s  %s\n", width, flag.label(), flag.usage)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "Run \"numskull help %s <flag>\" to explain a flag.\n", cmd.name)
+}
+
+//Prints the explanation of a single flag
+func (flag *flagDef) printHelp(w io.Writer) {
+	fmt.Fprintf(w, "%s  %s\n", flag.label(), flag.usage)
+	if len(flag.details) != 0 {
+		fmt.Fprintln(w)
+	}
+	for _, line := range flag.details {
+		fmt.Fprintln(w, line)
+	}
+}
+
+//Prints program usage
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: numskull <command> [flags] [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range allCommands() {
+		fmt.Fprintf(w, "\t%-8s  %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Without a command, the arguments are passed to run, like: numskull -i input.txt program.nms")
+	fmt.Fprintln(w, "Run \"numskull help <command>\" for the flags of a command.")
+}
+
+//Flag that sets a string
+func setString(target *string) func(string) error {
+	return func(value string) error {
+		*target = value
+		return nil
+	}
+}
+
+//Flag that turns something on
+func setTrue(target *bool) func(string) error {
+	return func(string) error {
+		*target = true
+		return nil
+	}
+}
+
+//Flag that sets a limit of 0 or more
+func setLimit(target *int) func(string) error {
+	return func(value string) error {
+		num, err := strconv.Atoi(value)
+		if err != nil || num < 0 {
+			return fmt.Errorf("invalid number '%s'", value)
+		}
+		*target = num
+		return nil
+	}
+}
+
+//Flag that picks one of several values
+func setChoice(target *string, valid func(string) bool, what string) func(string) error {
+	return func(value string) error {
+		value = strings.ToLower(value)
+		if !valid(value) {
+			return fmt.Errorf("unknown %s '%s'", what, value)
+		}
+		*target = value
+		return nil
+	}
+}
+
+//Entrypoint for "numskull help"
+func helpCommand() *command {
+	cmd := &command{
+		name:    "help",
+		args:    "[command] [flag]",
+		summary: "Explain a command or one of its flags",
+		details: []string{
+			"Without a command, lists every command.",
+			"A flag without a command is looked up in run, like: numskull help input",
+		},
+	}
+	cmd.run = func(args []string) int {
+		if len(args) == 0 {
+			printUsage(os.Stdout)
+			return exitOK
+		}
+
+		//Command, and maybe a flag
+		target := findCommand(args[0])
+		flagArgs := args[1:]
+		if target == nil {
+			target = runCommand()
+			flagArgs = args
+		} else if len(flagArgs) == 0 {
+			target.printHelp(os.Stdout)
+			return exitOK
+		}
+		if len(flagArgs) != 1 {
+			fmt.Fprintln(errorOutput, "Error: too many arguments")
+			return exitUsage
+		}
+
+		//Explain flag
+		flag := target.lookup(strings.TrimLeft(flagArgs[0], "-"))
+		if flag == nil {
+			fmt.Fprintf(errorOutput, "Error: numskull %s has no flag '%s'\n", target.name, flagArgs[0])
+			fmt.Fprintf(errorOutput, "Run \"numskull help %s\" to list them.\n", target.name)
+			return exitUsage
+		}
+		flag.printHelp(os.Stdout)
+		return exitOK
+	}
+	return cmd
+}
+
+//Entrypoint for "numskull version"
+func versionCommand() *command {
+	cmd := &command{
+		name:    "version",
+		summary: "Print the interpreter and language version",
+	}
+	cmd.run = func(args []string) int {
+		if len(args) != 0 {
+			fmt.Fprintln(errorOutput, "Error: version takes no arguments")
+			return exitUsage
+		}
+		fmt.Println("Numskull interpreter", version_interpreter)
+		fmt.Println("runs Numskull version", version_language)
+		return exitOK
+	}
+	return cmd
+}
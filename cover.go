@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"numskull/token"
+)
+
+//How often a condition went each way
+type branchCount struct {
+	taken   int64
+	skipped int64
+}
+
+//Coverage state
+var coverLines map[int]int64
+var coverBranches map[int]*branchCount
+var coverLastPos int
+
+//Clear recorded coverage
+func coverReset() {
+	coverLines = make(map[int]int64)
+	coverBranches = make(map[int]*branchCount)
+	coverLastPos = -1
+}
+
+//Count a line once every time it runs, not once for every instruction on it.
+//The line runs again when it's entered from another line, or jumped back to.
+func coverStep(pos int) {
+	line := lineAt(pos)
+	if coverLastPos < 0 || pos <= coverLastPos || lineAt(coverLastPos) != line {
+		coverLines[line]++
+	}
+	coverLastPos = pos
+}
+
+//Count the outcome of a condition
+func coverBranch(pos int, taken bool) {
+	line := lineAt(pos)
+	count, exists := coverBranches[line]
+	if !exists {
+		count = &branchCount{}
+		coverBranches[line] = count
+	}
+	if taken {
+		count.taken++
+	} else {
+		count.skipped++
+	}
+}
+
+//Save coverage, including lines that never ran
+func writeCoverage(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	//Find every line with an instruction, and every condition
+	lines := make([]int, 0, 64)
+	conditions := make(map[int]bool)
+	for pos := 0; pos < len(program); pos = nextInstruction(program, pos) {
+		line := lineAt(pos)
+		if len(lines) == 0 || lines[len(lines)-1] != line {
+			lines = append(lines, line)
+		}
+		if isCondition(program, pos) {
+			conditions[line] = true
+		}
+	}
+	sort.Ints(lines)
+
+	//One entry per line
+	w := bufio.NewWriter(file)
+	fmt.Fprintln(w, "mode: numskull")
+	written := make(map[int]bool)
+	for _, line := range lines {
+		if written[line] {
+			continue
+		}
+		written[line] = true
+
+		fmt.Fprintf(w, "%s:%d %d", programPath, line, coverLines[line])
+		if conditions[line] {
+			branch := coverBranches[line]
+			if branch == nil {
+				branch = &branchCount{}
+			}
+			fmt.Fprintf(w, " %d %d", branch.taken, branch.skipped)
+		}
+		fmt.Fprintln(w)
+	}
+
+	//Done
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+//Is the instruction at this position a condition?
+func isCondition(program []float64, pos int) bool {
+	if token.Token(program[pos]) != token.Number {
+		return false
+	}
+
+	//Skip lefthand chain
+	pos += 2
+	for token.Token(program[pos]) == token.ChainPlus || token.Token(program[pos]) == token.ChainMinus {
+		pos += 3
+	}
+
+	//Check operation
+	switch token.Token(program[pos]) {
+	case token.Equals, token.Different, token.LessThan, token.LessEquals, token.GreaterThan, token.GreaterEquals:
+		return true
+	}
+	return false
+}
+
+//Coverage of a single line
+type coverEntry struct {
+	count     int64
+	condition bool
+	taken     int64
+	skipped   int64
+}
+
+//Coverage of a whole file
+type coverFile struct {
+	path  string
+	lines map[int]*coverEntry
+}
+
+//Read a coverage file written by --cover
+func readCoverage(path string) ([]*coverFile, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	//Check header
+	rows := strings.Split(strings.ReplaceAll(string(raw), "\r", ""), "\n")
+	if len(rows) == 0 || rows[0] != "mode: numskull" {
+		return nil, fmt.Errorf("%s: not a numskull coverage file", path)
+	}
+
+	//Read entries
+	files := make([]*coverFile, 0, 1)
+	byPath := make(map[string]*coverFile)
+	for i, row := range rows[1:] {
+		if row == "" {
+			continue
+		}
+		bad := fmt.Errorf("%s:%d: invalid coverage entry '%s'", path, i+2, row)
+
+		//Split into location and numbers
+		fields := strings.Fields(row)
+		colon := strings.LastIndex(fields[0], ":")
+		if colon < 0 || (len(fields) != 2 && len(fields) != 4) {
+			return nil, bad
+		}
+		numbers := make([]int64, 0, 4)
+		for _, field := range append([]string{fields[0][colon+1:]}, fields[1:]...) {
+			num, err := strconv.ParseInt(field, 10, 64)
+			if err != nil {
+				return nil, bad
+			}
+			numbers = append(numbers, num)
+		}
+
+		//Add to file
+		name := fields[0][:colon]
+		file, exists := byPath[name]
+		if !exists {
+			file = &coverFile{path: name, lines: make(map[int]*coverEntry)}
+			byPath[name] = file
+			files = append(files, file)
+		}
+		entry := &coverEntry{count: numbers[1]}
+		if len(numbers) == 4 {
+			entry.condition = true
+			entry.taken = numbers[2]
+			entry.skipped = numbers[3]
+		}
+
+		//The same line can appear more than once, if coverage files were merged
+		if old, exists := file.lines[int(numbers[0])]; exists {
+			entry.count += old.count
+			entry.condition = entry.condition || old.condition
+			entry.taken += old.taken
+			entry.skipped += old.skipped
+		}
+		file.lines[int(numbers[0])] = entry
+	}
+
+	return files, nil
+}
+
+//Percentage of lines run and conditions that went both ways
+func (file *coverFile) summary() (float64, float64) {
+	lines, linesRun := 0, 0
+	conditions, conditionsFull := 0, 0
+	for _, entry := range file.lines {
+		lines++
+		if entry.count != 0 {
+			linesRun++
+		}
+		if entry.condition {
+			conditions++
+			if entry.taken != 0 && entry.skipped != 0 {
+				conditionsFull++
+			}
+		}
+	}
+
+	//Avoid division by zero
+	percent := func(part int, whole int) float64 {
+		if whole == 0 {
+			return 100
+		}
+		return float64(part) * 100 / float64(whole)
+	}
+	return percent(linesRun, lines), percent(conditionsFull, conditions)
+}
+
+//Entrypoint for "numskull cover"
+func coverCommand() *command {
+	htmlMode := false
+	outPath := ""
+
+	cmd := &command{
+		name:    "cover",
+		args:    "<coverage-file>",
+		summary: "Show a coverage file saved by run --cover",
+		details: []string{
+			"Without --html, prints the coverage of every file.",
+			"With --html, writes the source code annotated with coverage as HTML.",
+		},
+		flags: []*flagDef{
+			{name: "html", usage: "Write the annotated source code as HTML", set: setTrue(&htmlMode)},
+			{name: "output", short: "o", value: "<path>", usage: "File to write the report to, instead of the console", set: setString(&outPath)},
+		},
+	}
+	cmd.run = func(args []string) int {
+
+		//Coverage file required
+		if len(args) != 1 {
+			fmt.Fprintln(errorOutput, "Error: expected one coverage file")
+			fmt.Fprintln(errorOutput, "Run \"numskull help cover\" for usage.")
+			return exitUsage
+		}
+		files, err := readCoverage(args[0])
+		if err != nil {
+			fmt.Fprintln(errorOutput, "Error reading coverage file")
+			fmt.Fprintln(errorOutput, err.Error())
+			return exitError
+		}
+
+		//Where to write?
+		var out io.Writer = os.Stdout
+		if outPath != "" {
+			file, err := os.Create(outPath)
+			if err != nil {
+				fmt.Fprintln(errorOutput, "Error creating output file")
+				fmt.Fprintln(errorOutput, err.Error())
+				return exitError
+			}
+			defer file.Close()
+			out = file
+		}
+
+		//Text summary
+		if !htmlMode {
+			for _, file := range files {
+				lines, conditions := file.summary()
+				fmt.Fprintf(out, "%s\tlines: %.1f%%\tconditions: %.1f%%\n", file.path, lines, conditions)
+			}
+			return exitOK
+		}
+
+		//HTML report
+		if err := writeCoverageHTML(out, files); err != nil {
+			fmt.Fprintln(errorOutput, "Error writing HTML")
+			fmt.Fprintln(errorOutput, err.Error())
+			return exitError
+		}
+		return exitOK
+	}
+	return cmd
+}
+
+//One source line in the HTML report
+type coverHTMLLine struct {
+	Number int
+	Source string
+	Class  string
+	Count  string
+	Title  string
+}
+
+//One source file in the HTML report
+type coverHTMLFile struct {
+	Path       string
+	Lines      []coverHTMLLine
+	LinePct    string
+	BranchPct  string
+	ReadFailed string
+}
+
+//Render annotated source code
+func writeCoverageHTML(out io.Writer, files []*coverFile) error {
+	pages := make([]coverHTMLFile, 0, len(files))
+	for _, file := range files {
+		linePct, branchPct := file.summary()
+		page := coverHTMLFile{
+			Path:      file.path,
+			LinePct:   fmt.Sprintf("%.1f%%", linePct),
+			BranchPct: fmt.Sprintf("%.1f%%", branchPct),
+		}
+
+		//Read source code
+		raw, err := os.ReadFile(file.path)
+		if err != nil {
+			page.ReadFailed = err.Error()
+			pages = append(pages, page)
+			continue
+		}
+
+		//Annotate every line
+		source := strings.Split(strings.ReplaceAll(string(raw), "\r", ""), "\n")
+		for i, text := range source {
+			line := coverHTMLLine{Number: i + 1, Source: text}
+			if entry, exists := file.lines[i+1]; exists {
+				line.Count = strconv.FormatInt(entry.count, 10)
+				switch {
+				case entry.count == 0:
+					line.Class = "miss"
+					line.Title = "not executed"
+				case entry.condition && (entry.taken == 0 || entry.skipped == 0):
+					line.Class = "partial"
+					line.Title = fmt.Sprintf("taken %d, skipped %d", entry.taken, entry.skipped)
+				case entry.condition:
+					line.Class = "hit"
+					line.Title = fmt.Sprintf("taken %d, skipped %d", entry.taken, entry.skipped)
+				default:
+					line.Class = "hit"
+					line.Title = fmt.Sprintf("executed %d times", entry.count)
+				}
+			}
+			page.Lines = append(page.Lines, line)
+		}
+		pages = append(pages, page)
+	}
+
+	return coverTemplate.Execute(out, pages)
+}
+
+//Template for the HTML report
+var coverTemplate = template.Must(template.New("cover").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Numskull coverage</title>
+<style>
+body { background: #fff; color: #222; font-family: sans-serif; }
+table { border-collapse: collapse; font-family: monospace; }
+td { padding: 0 8px; white-space: pre; }
+td.num { color: #888; text-align: right; }
+tr.hit td.src { background: #c8f0c8; }
+tr.miss td.src { background: #f4c0c0; }
+tr.partial td.src { background: #f4e4a0; }
+</style>
+</head>
+<body>
+{{range .}}
+<h2>{{.Path}}</h2>
+{{if .ReadFailed}}<p>Could not read source: {{.ReadFailed}}</p>{{else}}
+<p>Lines run: {{.LinePct}}, conditions both taken and skipped: {{.BranchPct}}</p>
+<table>
+{{range .Lines}}<tr class="{{.Class}}" title="{{.Title}}"><td class="num">{{.Number}}</td><td class="num">{{.Count}}</td><td class="src">{{.Source}}</td></tr>
+{{end}}</table>
+{{end}}{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"unicode/utf8"
+)
+
+//Input formats besides the binary encodings
+const (
+	inputBytes string = "bytes"
+	inputText  string = "text"
+)
+
+//Output format besides the binary encodings
+const outputText string = "text"
+
+//Kinds of binary encodings
+const (
+	encodingFloat    byte = 'f'
+	encodingSigned   byte = 'i'
+	encodingUnsigned byte = 'u'
+)
+
+//A fixed size binary encoding for numbers
+type numberEncoding struct {
+	size  int
+	kind  byte
+	order binary.ByteOrder
+}
+
+//Every binary encoding, by name
+var numberEncodings = map[string]numberEncoding{
+	"f64le": {8, encodingFloat, binary.LittleEndian},
+	"f64be": {8, encodingFloat, binary.BigEndian},
+	"f32le": {4, encodingFloat, binary.LittleEndian},
+	"f32be": {4, encodingFloat, binary.BigEndian},
+	"i32le": {4, encodingSigned, binary.LittleEndian},
+	"i32be": {4, encodingSigned, binary.BigEndian},
+	"u32le": {4, encodingUnsigned, binary.LittleEndian},
+	"u32be": {4, encodingUnsigned, binary.BigEndian},
+	"i16le": {2, encodingSigned, binary.LittleEndian},
+	"i16be": {2, encodingSigned, binary.BigEndian},
+	"u16le": {2, encodingUnsigned, binary.LittleEndian},
+	"u16be": {2, encodingUnsigned, binary.BigEndian},
+}
+
+//Input format that reads one unicode character at a time
+const inputUTF8 string = "utf8"
+
+//Is this a known input format?
+func validInputFormat(format string) bool {
+	_, exists := numberEncodings[format]
+	return exists || format == inputBytes || format == inputText || format == inputUTF8
+}
+
+//Is this a known output format?
+func validOutputFormat(format string) bool {
+	_, exists := numberEncodings[format]
+	return exists || format == outputText
+}
+
+//Encode a single value.
+//Integer encodings only take whole numbers that fit, float32 rounds to the nearest value.
+func (enc numberEncoding) encode(name string, val float64) ([]byte, error) {
+	raw := make([]byte, enc.size)
+	if enc.kind == encodingFloat {
+		if enc.size == 4 {
+			enc.putBits(raw, uint64(math.Float32bits(float32(val))))
+		} else {
+			enc.putBits(raw, math.Float64bits(val))
+		}
+		return raw, nil
+	}
+
+	//Check range
+	low, high := 0.0, math.Ldexp(1, enc.size*8)
+	if enc.kind == encodingSigned {
+		low, high = -high/2, high/2
+	}
+	if val != math.Trunc(val) || val < low || val >= high {
+		return nil, fmt.Errorf("can't write %s as %s", formatTraceNumber(val), name)
+	}
+	enc.putBits(raw, uint64(int64(val)))
+	return raw, nil
+}
+
+//Decode input, which must be made of whole values
+func (enc numberEncoding) decode(name string, raw []byte) ([]float64, error) {
+	if len(raw)%enc.size != 0 {
+		return nil, fmt.Errorf("input is %d bytes, which is not a multiple of %d for %s", len(raw), enc.size, name)
+	}
+
+	numbers := make([]float64, 0, len(raw)/enc.size)
+	shift := 64 - enc.size*8
+	for pos := 0; pos < len(raw); pos += enc.size {
+		bits := enc.bits(raw[pos : pos+enc.size])
+		switch {
+		case enc.kind == encodingFloat && enc.size == 4:
+			numbers = append(numbers, float64(math.Float32frombits(uint32(bits))))
+		case enc.kind == encodingFloat:
+			numbers = append(numbers, math.Float64frombits(bits))
+		case enc.kind == encodingSigned:
+			numbers = append(numbers, float64(int64(bits<<shift)>>shift))
+		default:
+			numbers = append(numbers, float64(bits))
+		}
+	}
+	return numbers, nil
+}
+
+//Store the lowest bytes of bits
+func (enc numberEncoding) putBits(raw []byte, bits uint64) {
+	switch enc.size {
+	case 8:
+		enc.order.PutUint64(raw, bits)
+	case 4:
+		enc.order.PutUint32(raw, uint32(bits))
+	default:
+		enc.order.PutUint16(raw, uint16(bits))
+	}
+}
+
+//Read a value as bits
+func (enc numberEncoding) bits(raw []byte) uint64 {
+	switch enc.size {
+	case 8:
+		return enc.order.Uint64(raw)
+	case 4:
+		return uint64(enc.order.Uint32(raw))
+	}
+	return uint64(enc.order.Uint16(raw))
+}
+
+//Convert input to one number per unicode character.
+//Invalid UTF-8 reads as the replacement character, one byte at a time.
+func utf8Input(raw []byte) []float64 {
+	numbers := make([]float64, 0, len(raw))
+	for len(raw) != 0 {
+		char, size := utf8.DecodeRune(raw)
+		numbers = append(numbers, float64(char))
+		raw = raw[size:]
+	}
+	return numbers
+}
+
+//Convert input in any input format to numbers
+func decodeInput(format string, raw []byte) ([]float64, error) {
+	switch format {
+	case inputBytes:
+		return binaryInput(raw), nil
+	case inputText:
+		return textInput(raw)
+	case inputUTF8:
+		return utf8Input(raw), nil
+	}
+	return numberEncodings[format].decode(format, raw)
+}
@@ -1,32 +1,30 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"strconv"
+	"strings"
 
 	"numskull/parser"
 	"numskull/token"
-	"numskull/utils"
-)
-
-//Usage strings
-const (
-	usage_v string = "-v, --version         Prints program version number"
-	usage_h string = "-h, --help <argument> Prints usage for given argument"
-	usage_i string = "-i, --input <path>    File to read input from"
-	usage_o string = "-o, --output <path>   File to print output to"
-	usage_t string = "-t, --type            Tells program to read input file as text"
-	usage_c string = "-c, --console         Force program output to console"
 )
 
 //Version numbers
 const (
 	version_interpreter string = "v0.3"
-	version_language    string = "1.2"
+	version_language    string = "1.3"
 )
 
 //Runtime variables
 var program []float64
+var programLines []int
+var programPath string
+var sourceLines []string
 var memory map[float64]float64 = make(map[float64]float64)
 var input []float64
 var inputPos int
@@ -34,336 +32,600 @@ var inputPos int
 //Settings
 var consoleOutput bool = true
 var readFromFile bool = false
-var inputBinary bool = true
+var consoleInput bool = true
+var inputFormat string = inputBytes
 var writeToFile bool = false
 var outputFile *os.File = nil
+var consoleWriter io.Writer = os.Stdout
+var stdin *bufio.Reader = bufio.NewReader(os.Stdin)
+var maxCallDepth int = 10000
+var maxSteps int = 0
+var traceOutput io.Writer = os.Stderr
+var errorOutput io.Writer = os.Stderr
+var tracing bool = false
+var traceFormat string = traceText
+var profiling bool = false
+var profilePath string
+var profileFormat string = profileText
+var covering bool = false
+var coverPath string
+var charMode string = charUnicode
+var invalidChar string = invalidCharError
+var numberFormat string = numberShortest
+var numberDecimals int = -1
+var outputFormat string = outputText
+
+//Call stack size that triggers a warning
+const callstackWarning int = 32
+
+//Number of frames listed on a stack overflow
+const overflowFrames int = 10
+
+//Entry on the call stack
+type callFrame struct {
+	returnPos int
+	function  float64
+	entry     int
+}
 
 //Entrypoint, reads command line arguments
 func main() {
+	os.Exit(runCLI(os.Args[1:]))
+}
 
-	//Uncomment only for debugging
-	/*os.Args = []string{
-		os.Args[0],
-		//"--input", "examples/hello.bf",
-		//"examples/brainfrick.nms",
-	}*/
-
-	//No arguments provided
-	fmt.Println()
-	if len(os.Args) == 1 {
-
-		printUsage()
-		return
+//Entrypoint for "numskull run"
+func runCommand() *command {
+	inputPath := ""
+	outputPath := ""
+	forceConsole := false
+	inline := make([]string, 0, 1)
+
+	cmd := &command{
+		name:    "run",
+		args:    "<program-file>",
+		summary: "Run a program",
+		details: []string{
+			"The program file can be source code, or bytecode made by \"numskull build\".",
+			"A program file of - reads the program from stdin, and -e runs code given on the command line instead.",
+		},
+	}
+	traceDetails := []string{
+		"Tracing logs every instruction the program executes to stderr, one per line.",
+		"Each line holds the program offset, the source line, the operation, the lefthand address after chaining,",
+		"the values read and written, and whether a condition was taken or not.",
+		"The text format is meant for reading, the json format writes one JSON object per line (JSON Lines).",
+		"Both formats are stable, so traces of two versions of a program can be compared with diff.",
+		"",
+		"Example: numskull run --trace --trace-format=json program.nms 2> trace.jsonl",
+		"Runs program.nms, and saves the trace to trace.jsonl.",
+	}
+	profileDetails := []string{
+		"Counts how many instructions are executed on each source line and in each function.",
+		"Functions are counted both by their own instructions (self), and including",
+		"everything run through the () calls they make (inclusive).",
+		"The text format is a report listing the busiest lines and functions first.",
+		"The pprof format can be opened using \"go tool pprof\".",
+		"The profile is also saved if the program stops due to an error.",
+		"",
+		"Example: numskull run --profile out.txt program.nms",
+		"Runs program.nms, and saves a hot-spot report to out.txt.",
+	}
+	charDetails := []string{
+		"In unicode mode (the default), # writes the UTF-8 encoding of the code point in the lefthand.",
+		"In byte mode, # writes a single byte like older versions did. Whole numbers outside 0-255 wrap around.",
+		"Fractional, NaN and infinite values are invalid, and so are values that aren't unicode characters in unicode mode.",
+		"By default invalid values stop the program with an error.",
+		"With replace, they're written as the replacement character U+FFFD instead, or '?' in byte mode.",
+		"",
+		"Example: numskull run --char-mode byte -o out.bin program.nms",
+		"Runs program.nms, and writes one byte to out.bin for every #.",
+	}
+	formatDetails := []string{
+		"Binary encodings store every number as a fixed number of bytes:",
+		"\tf64le, f64be   64 bit floating point, little or big endian",
+		"\tf32le, f32be   32 bit floating point, little or big endian",
+		"\ti32le, i32be   32 bit signed integer, little or big endian",
+		"\tu32le, u32be   32 bit unsigned integer, little or big endian",
+		"\ti16le, i16be   16 bit signed integer, little or big endian",
+		"\tu16le, u16be   16 bit unsigned integer, little or big endian",
+		"With a binary output format, every ! and # writes the value itself to the -o file, instead of text.",
+		"Writing a fraction or a number that doesn't fit using an integer encoding stops the program with an error.",
+		"With a binary input format, every \" reads the next value from the -i file. After the end of the file, the result is -1.",
+		"The input formats bytes (the default) and text read input the same way as without and with -t.",
+		"The input format utf8 reads one unicode character per \", invalid UTF-8 reads as U+FFFD.",
+		"",
+		"Example: numskull run --output-format f64le -o out.bin first.nms",
+		"         numskull run --input-format f64le -i out.bin second.nms",
+		"Passes every number printed by first.nms to second.nms, without losing any precision.",
 	}
 
-	//Variables
-	var forceConsole bool = false
-	var inputRaw []byte
-
-	//Read and process arguments
-	var somethingDone bool = false
-	for argPos := 1; argPos < len(os.Args); argPos++ {
-		switch os.Args[argPos] {
+	cmd.flags = []*flagDef{
+		{
+			name: "eval", short: "e", value: "<code>", usage: "Run this code, instead of a program file",
+			details: []string{
+				"Runs a snippet of code given on the command line, without needing a program file.",
+				"Every -e is a line of the program, in the order they're given.",
+				"Input is read from the console, unless -i is given.",
+				"",
+				"Example: numskull -e '65#'",
+				"Prints the letter A.",
+				"",
+				"Example: numskull -e '1 = 3' -e '1 ?> 0 [' -e '1!' -e '1--' -e ']'",
+				"Counts down from 3.",
+			},
+			set: func(value string) error {
+				inline = append(inline, value)
+				return nil
+			},
+		},
+		{
+			name: "input", short: "i", value: "<path>", usage: "File to read input from",
+			details: []string{
+				"When reading after the end of file, the result is always -1.",
+				"If this flag isn't present, input is given through the console.",
+				"Input file will be read as binary by default, look up \"numskull help run type\" for more info.",
+				"",
+				"Example: numskull run -i numbers.bin program.nms",
+				"Opens program.nms, and reads from numbers.bin when reading input.",
+			},
+			set: setString(&inputPath),
+		},
+		{
+			name: "type", short: "t", usage: "Read the input file as text",
+			details: []string{
+				"Normally when reading input from a file, the input will be read as binary.",
+				"That is, one byte per input, each consisting of a number from 0 to 255.",
+				"Some may not want this behaviour, so passing in -t will make input read as text.",
+				"Entries are read as numbers, seperated by whitespace (tabs, spaces, or newlines).",
+				"Numbers can look like 12, -2.5, 0,5, +3, 1e6, 0x1F, 0o17, 0b101, inf, -infinity or nan.",
+				"An incorrectly formatted entry is an error, naming the entry and what's wrong with it.",
+				"Numbers typed into the console are read the same way.",
+				"If the -i flag isn't present, this flag does nothing.",
+			},
+			set: func(string) error {
+				inputFormat = inputText
+				return nil
+			},
+		},
+		{
+			name: "output", short: "o", value: "<path>", usage: "File to print output to",
+			details: []string{
+				"When outputting, you can choose to also write that output to a file.",
+				"The file is treated as a byte array.",
+				"If this flag isn't present, the output of the program is displayed in the console.",
+				"If you still want console output AND saving to a file, use the -c flag.",
+				"If the program stops due to an error, the file is still saved.",
+				"",
+				"Example: numskull run -o numbers.bin program.nms",
+				"Opens program.nms, and saves output to numbers.bin, once the program stops running.",
+			},
+			set: setString(&outputPath),
+		},
+		{
+			name: "console", short: "c", usage: "Force program output to console",
+			details: []string{
+				"When outputting to a file, console output is turned off by default.",
+				"Use this flag to reenable it, while also writing the output to a file, using -o.",
+				"If the -o flag isn't present, this flag does nothing.",
+			},
+			set: setTrue(&forceConsole),
+		},
+		{
+			name: "quiet", short: "q", usage: "Don't print errors and warnings",
+			details: []string{
+				"Errors and warnings from the interpreter are printed to stderr, and program output to stdout.",
+				"With this flag, errors and warnings aren't printed at all. The exit code still tells what happened:",
+				"\t0   the program finished",
+				"\t1   the program stopped with an error, or a file couldn't be read or written",
+				"\t2   the command line is wrong",
+				"\t3   the program contains errors, and didn't run",
+				"\t4   the program went past --max-steps or --max-call-depth",
+				"Traces asked for with --trace are still written.",
+				"",
+				"Example: numskull run -q program.nms > out.txt || echo \"failed with $?\"",
+			},
+			set: func(string) error {
+				errorOutput = io.Discard
+				return nil
+			},
+		},
+		{
+			name: "max-call-depth", short: "d", value: "<n>", usage: "Maximum depth of the call stack",
+			details: []string{
+				"Limits how many function calls can be active at the same time.",
+				"Calling a function beyond this depth stops the program with a stack overflow error.",
+				"Set it to 0 to remove the limit. The default is " + strconv.Itoa(maxCallDepth) + " calls.",
+				"",
+				"Example: numskull run --max-call-depth=500 program.nms",
+				"Runs program.nms, but stops it once 500 function calls are active.",
+			},
+			set: setLimit(&maxCallDepth),
+		},
+		{
+			name: "max-steps", short: "s", value: "<n>", usage: "Maximum number of instructions to execute",
+			details: []string{
+				"Stops the program with an error once it has executed this many instructions.",
+				"Useful for programs that might never finish. Set it to 0 to remove the limit, which is the default.",
+				"",
+				"Example: numskull run --max-steps=1000000 program.nms",
+			},
+			set: setLimit(&maxSteps),
+		},
+		{
+			name: "trace", usage: "Log every executed instruction to stderr",
+			details: traceDetails,
+			set:     setTrue(&tracing),
+		},
+		{
+			name: "trace-format", value: "<format>", usage: "Trace format, either text or json, enables tracing",
+			details: traceDetails,
+			set: func(value string) error {
+				tracing = true
+				return setChoice(&traceFormat, validTraceFormat, "trace format")(value)
+			},
+		},
+		{
+			name: "profile", value: "<path>", usage: "Count executed instructions per line and function",
+			details: profileDetails,
+			set: func(value string) error {
+				profiling = true
+				profilePath = value
+				return nil
+			},
+		},
+		{
+			name: "profile-format", value: "<format>", usage: "Profile format, either text or pprof",
+			details: profileDetails,
+			set:     setChoice(&profileFormat, validProfileFormat, "profile format"),
+		},
+		{
+			name: "cover", value: "<path>", usage: "Save which lines and conditions were run",
+			details: []string{
+				"Records how many times each line was run, and how many times each condition",
+				"was taken and skipped, then saves it to a coverage file.",
+				"The coverage file can be turned into annotated source code using \"numskull cover --html\".",
+				"",
+				"Example: numskull run --cover cover.out program.nms",
+				"         numskull cover --html -o cover.html cover.out",
+				"Runs program.nms, and renders the lines it ran into cover.html.",
+			},
+			set: func(value string) error {
+				covering = true
+				coverPath = value
+				return nil
+			},
+		},
+		{
+			name: "char-mode", value: "<mode>", usage: "Output of #, either unicode or byte",
+			details: charDetails,
+			set:     setChoice(&charMode, validCharMode, "character mode"),
+		},
+		{
+			name: "invalid-char", value: "<action>", usage: "What # does with invalid values, either error or replace",
+			details: charDetails,
+			set:     setChoice(&invalidChar, validInvalidChar, "invalid character action"),
+		},
+		{
+			name: "number-format", value: "<format>", usage: "Output of !, either shortest, fixed, integer or scientific",
+			details: []string{
+				"Picks how ! writes numbers, both to the console and to the -o file.",
+				"shortest (the default) writes as few digits as needed to read the exact number back, never using exponents.",
+				"fixed writes a fixed number of decimals, 6 unless given like fixed:2.",
+				"integer writes whole numbers only, and stops the program with an error on anything else.",
+				"scientific writes numbers like 1.5e+21, with as few decimals as needed unless given like scientific:3.",
+				"NaN and infinite values are written as NaN, Inf and -Inf, except in integer format where they're an error.",
+				"",
+				"Example: numskull run --number-format=fixed:2 program.nms",
+				"Runs program.nms, and prints every number with two decimals.",
+			},
+			set: func(value string) error {
+				format, decimals, err := parseNumberFormat(value)
+				if err != nil {
+					return err
+				}
+				numberFormat, numberDecimals = format, decimals
+				return nil
+			},
+		},
+		{
+			name: "input-format", value: "<format>", usage: "How the input file is read, bytes, text, utf8 or a binary encoding",
+			details: formatDetails,
+			set:     setChoice(&inputFormat, validInputFormat, "input format"),
+		},
+		{
+			name: "output-format", value: "<format>", usage: "How the output file is written, text or a binary encoding",
+			details: formatDetails,
+			set:     setChoice(&outputFormat, validOutputFormat, "output format"),
+		},
+	}
 
-		//Help :)
-		case "-h", "-H", "--help":
-			argPos++
+	cmd.run = func(args []string) int {
 
-			//No help thing provided
-			if argPos == len(os.Args) {
-				fmt.Println("Error: specify an argument to explain.")
-				fmt.Println("Example:", os.Args[0], os.Args[argPos-1], "v")
-				fmt.Println("Pass in no arguments to see list of available arguments.")
-				return
+		//Code from the command line
+		if len(inline) != 0 {
+			if len(args) != 0 {
+				fmt.Fprintln(errorOutput, "Error: expected no program file when using -e")
+				fmt.Fprintln(errorOutput, "Run \"numskull help run\" for usage.")
+				return exitUsage
 			}
-
-			switch os.Args[argPos] {
-
-			//Help for the version tag
-			case "v", "V", "version":
-				fmt.Println(usage_v)
-				fmt.Println("That's it really.")
-
-			//Help for the help tag
-			case "h", "H", "help":
-				fmt.Println(usage_h)
-				fmt.Println()
-				fmt.Println("Example: numskull", os.Args[argPos-1], "v")
-				fmt.Println("Shows the help page for the parameter '-v'.")
-				fmt.Println("The program stops once help has been printed.")
-
-			//Help for the input tag
-			case "i", "I", "input":
-				if len(os.Args[argPos]) != 1 {
-					os.Args[argPos] = "-" + os.Args[argPos]
-				}
-				fmt.Println(usage_i)
-				fmt.Println()
-				fmt.Println("When reading after the end of file, the result is always -1.")
-				fmt.Println("If this argument isn't present, input is given through the console.")
-				fmt.Println("Input file will be read as binary by default, look up \"numskull --help -t\" for more info.")
-				fmt.Println()
-				fmt.Println("Example: numskull", "-"+os.Args[argPos], "numbers.bin program.nms")
-				fmt.Println("Opens program.nms, and reads from numbers.bin when reading input.")
-
-			//Help for the output tag
-			case "o", "O", "output":
-				if len(os.Args[argPos]) != 1 {
-					os.Args[argPos] = "-" + os.Args[argPos]
-				}
-				fmt.Println(usage_o)
-				fmt.Println()
-				fmt.Println("When outputting, you can choose to also write that output to a file.")
-				fmt.Println("The file is treated as a byte array.")
-				fmt.Println("If this argument isn't present, the output of the program is displayed in the console.")
-				fmt.Println("If you still want console output AND saving to a file, use the \"-c\" argument.")
-				fmt.Println("If the program stops due to an error, the file is still saved.")
-				fmt.Println()
-				fmt.Println("Example: numskull", "-"+os.Args[argPos], "numbers.bin program.nms")
-				fmt.Println("Opens program.nms, and saves output to numbers.bin, once the program stops running.")
-
-			//Help for the type tag
-			case "t", "T", "type":
-				if len(os.Args[argPos]) != 1 {
-					os.Args[argPos] = "-" + os.Args[argPos]
-				}
-				fmt.Println(usage_t)
-				fmt.Println()
-				fmt.Println("Normally when reading input from a file, the input will be read as binary.")
-				fmt.Println("That is, one byte per input, each consisting of a number from 0 to 255.")
-				fmt.Println("Some may not want this behaviour, so passing in", "-"+os.Args[argPos], "will make input read as text.")
-				fmt.Println("Entries are read as numbers, seperated by whitespace (tabs, spaces, or newlines).")
-				fmt.Println("An incorrectly formatted entry will cause an error when trying to read it.")
-				fmt.Println("If the -i argument isn't present, this argument does nothing.")
-
-			//Help for the console tag
-			case "c", "C", "console":
-				fmt.Println(usage_c)
-				fmt.Println()
-				fmt.Println("When outputting to a file, console output is turned off by default.")
-				fmt.Println("Use this argument to reenable it, while also writing the output to a file, using -o.")
-				fmt.Println("If the -o argument isn't present, this argument does nothing.")
-
-			default:
-				fmt.Println("Error: unknown argument.")
-				fmt.Println()
-				printUsage()
-				return
+			if status := loadSource("<eval>", []byte(strings.Join(inline, "\n"))); status != exitOK {
+				return status
 			}
+			return runLoaded(inputPath, outputPath, forceConsole)
+		}
 
-			//Exit
-			return
+		if len(args) != 1 {
+			fmt.Fprintln(errorOutput, "Error: expected one program file")
+			fmt.Fprintln(errorOutput, "Run \"numskull help run\" for usage.")
+			return exitUsage
+		}
+		return runFile(args[0], inputPath, outputPath, forceConsole)
+	}
+	return cmd
+}
 
-		//Print numskull version
-		case "-v", "-V", "--version":
-			fmt.Println("Numskull interpreter", version_interpreter)
-			fmt.Println("runs Numskull version", version_language)
-			somethingDone = true
+//Load a program, from source code or bytecode.
+//A path of "-" reads the program from stdin.
+//Errors are printed, and the exit code for them is returned.
+func loadProgram(path string) int {
+	var file []byte
+	var err error
+	if path == "-" {
+		file, err = io.ReadAll(stdin)
+		path = "<stdin>"
+	} else {
+		file, err = os.ReadFile(path)
+	}
+	if err != nil {
+		fmt.Fprintln(errorOutput, "Error opening program file")
+		fmt.Fprintln(errorOutput, err.Error())
+		return exitError
+	}
+	return loadSource(path, file)
+}
 
-		//Force console output
-		case "-c", "-C", "--console":
-			forceConsole = true
+//Load a program that was already read, from source code or bytecode
+func loadSource(path string, file []byte) int {
+	var err error
+	programPath = path
 
-		//Text reading mode
-		case "-t", "-T", "--type":
-			inputBinary = false
+	//Bytecode
+	if isBytecode(file) {
+		program, programLines, err = readBytecode(file)
+		sourceLines = nil
+		if err != nil {
+			fmt.Fprintln(errorOutput, "Error reading bytecode")
+			fmt.Fprintln(errorOutput, err.Error())
+			return exitParse
+		}
+		return exitOK
+	}
 
-		//Specify output file
-		case "-o", "-O", "--output":
-			argPos++
+	//Source code
+	sourceLines = strings.Split(string(file), "\n")
+	parsed, diagnostics := parser.Parse(file)
+	for _, d := range diagnostics {
+		fmt.Fprintln(errorOutput, d.Error())
+	}
+	program, programLines = parsed.Code, parsed.Lines
+	if len(diagnostics) != 0 {
+		return exitParse
+	}
+	return exitOK
+}
 
-			//No file specified
-			if argPos >= len(os.Args)-1 {
-				fmt.Println("Error: no output file specified")
-				fmt.Println(usage_o)
-				break
-			}
+//Run a program file, returns the exit code
+func runFile(path string, inputPath string, outputPath string, forceConsole bool) int {
+	if status := loadProgram(path); status != exitOK {
+		return status
+	}
 
-			//Update stuff
-			var err error
-			outputFile, err = os.Create(os.Args[argPos])
-			if err != nil {
-				fmt.Println("Error creating output file")
-				fmt.Println(err.Error())
-				return
-			}
-			consoleOutput = false
-			writeToFile = true
-
-		//Read input file
-		case "-i", "-I", "--input":
-			argPos++
-
-			//No file specified
-			if argPos >= len(os.Args)-1 {
-				fmt.Println("Error: no input file specified")
-				fmt.Println(usage_i)
-				break
-			}
+	//Stdin holds the program, so it can't hold input too
+	if path == "-" {
+		consoleInput = false
+	}
+	return runLoaded(inputPath, outputPath, forceConsole)
+}
 
-			//Open file
-			raw, err := os.ReadFile(os.Args[argPos])
-			if err != nil {
-				fmt.Println("Error while opening input file")
-				fmt.Println(err.Error())
-				fmt.Println(usage_i)
-				return
-			}
+//Run the loaded program, returns the exit code
+func runLoaded(inputPath string, outputPath string, forceConsole bool) int {
 
-			//Read thing
-			inputRaw = raw
-			readFromFile = true
+	//Read input file
+	if inputPath != "" {
+		raw, err := os.ReadFile(inputPath)
+		if err != nil {
+			fmt.Fprintln(errorOutput, "Error while opening input file")
+			fmt.Fprintln(errorOutput, err.Error())
+			return exitError
+		}
+		input, err = decodeInput(inputFormat, raw)
+		if err != nil {
+			fmt.Fprintln(errorOutput, "Error when converting input file")
+			fmt.Fprintln(errorOutput, err.Error())
+			return exitError
+		}
+		readFromFile = true
+	}
 
-		//Unknown parameter
-		default:
-			if argPos == len(os.Args)-1 {
-				break
-			}
+	//Create output file
+	if outputPath != "" {
+		var err error
+		outputFile, err = os.Create(outputPath)
+		if err != nil {
+			fmt.Fprintln(errorOutput, "Error creating output file")
+			fmt.Fprintln(errorOutput, err.Error())
+			return exitError
+		}
+		defer outputFile.Close()
+		consoleOutput = forceConsole
+		writeToFile = true
+	}
 
-			fmt.Println("Error: Unknown argument: " + os.Args[argPos])
-			printUsage()
-			return
+	//Run program
+	if profiling {
+		profileReset()
+	}
+	if covering {
+		coverReset()
+	}
+	err := runProgram(program)
+
+	//Save coverage
+	saved := true
+	if covering {
+		if cerr := writeCoverage(coverPath); cerr != nil {
+			fmt.Fprintln(errorOutput, "Error writing coverage")
+			fmt.Fprintln(errorOutput, cerr.Error())
+			saved = false
 		}
 	}
 
-	//No more arguments? Was anything achieved?
-	finArg := os.Args[len(os.Args)-1]
-	if finArg[0] == '-' && somethingDone {
-		return
+	//Save profile
+	if profiling {
+		if perr := writeProfile(profilePath, profileFormat); perr != nil {
+			fmt.Fprintln(errorOutput, "Error writing profile")
+			fmt.Fprintln(errorOutput, perr.Error())
+			saved = false
+		}
 	}
 
-	//Try to read program file
-	file, err := os.ReadFile(finArg)
+	//Print error, program output stays alone on stdout
 	if err != nil {
-		fmt.Println("Error opening program file")
-		fmt.Println(err.Error())
-		return
+		fmt.Fprintln(errorOutput, err.Error())
+		if errors.As(err, &limitError{}) {
+			return exitLimit
+		}
+		return exitError
 	}
+	if !saved {
+		return exitError
+	}
+	return exitOK
+}
 
-	//Read input file
-	if readFromFile {
-
-		//Convert input from text to []float64
-		if !inputBinary {
-			input = make([]float64, len(inputRaw)/5)[:0]
-			pos := 0
-			for {
-				numData := make([]byte, 64)[:0]
-				foundChar := false
-				foundComma := false
-				foundWhitespace := false
-
-				//Read ONE number
-				for {
-					if pos == len(inputRaw) || foundWhitespace {
-						break
-					}
-
-					//Read char
-					char := inputRaw[pos]
-					pos++
-
-					switch char {
-
-					//Numbers
-					case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-						foundChar = true
-						numData = append(numData, char)
-
-					//Decimal indicators
-					case '.', ',':
-						if !foundChar {
-							numData = append(numData, '0')
-							foundChar = true
-						}
-						if foundComma {
-							fmt.Println("Error converting number")
-							fmt.Println("Double commas on entry", len(input)+1, ".")
-							return
-						}
-						foundComma = true
-						numData = append(numData, '.')
-
-					//Minus sign
-					case '-':
-						if foundChar {
-							fmt.Println("Error converting number")
-							fmt.Println("Unexpected character encountered '", string(char), "' on entry", len(input)+1)
-							return
-						}
-						foundChar = true
-						numData = append(numData, char)
-
-					//Whitespace
-					case ' ', 0x0D, '\t', '\n':
-						if !foundChar {
-							continue
-						} else {
-							foundWhitespace = true
-						}
-
-					//Unknown character
-					default:
-						fmt.Println("Error converting number")
-						fmt.Println("Unexpected character encountered '", string(char), "' on entry", len(input)+1)
-						return
-					}
-				}
-
-				//Convert to number
-				number, err := utils.BytesliceToNumber(numData)
-				if err != nil {
-					fmt.Println("Error when converting input file")
-					fmt.Println(err.Error())
-					return
-				}
-				input = append(input, number)
+//Convert input from []byte to []float64, one number per byte
+func binaryInput(raw []byte) []float64 {
+	numbers := make([]float64, len(raw))
+	for i := 0; i < len(raw); i++ {
+		numbers[i] = float64(raw[i])
+	}
+	return numbers
+}
 
-				//Is this all?
-				if pos == len(inputRaw) {
-					break
-				}
-			}
+//Convert input from text to []float64, entries are seperated by whitespace
+func textInput(raw []byte) ([]float64, error) {
+	entries := strings.Fields(string(raw))
+	numbers := make([]float64, 0, len(entries))
+	for i, entry := range entries {
+		number, err := parseTextNumber(entry)
+		if err != nil {
+			return nil, fmt.Errorf("entry %d '%s': %s", i+1, entry, err.Error())
 		}
+		numbers = append(numbers, number)
+	}
+	return numbers, nil
+}
 
-		//Convert from []byte to []float64
-		if inputBinary {
-			input = make([]float64, len(inputRaw))
-			for i := 0; i < len(inputRaw); i++ {
-				input[i] = float64(inputRaw[i])
-			}
+//Read a single number from text input.
+//Takes decimals with . or , as the decimal point, exponents like 1e6, a leading + or -,
+//0x, 0o and 0b integers, and inf, infinity and nan.
+func parseTextNumber(entry string) (float64, error) {
+	text := entry
+
+	//Sign
+	sign := 1.0
+	if strings.HasPrefix(text, "+") || strings.HasPrefix(text, "-") {
+		if text[0] == '-' {
+			sign = -1
 		}
+		text = text[1:]
+	}
+	if text == "" {
+		return 0, fmt.Errorf("expected digits after sign")
 	}
 
-	//Console?
-	if forceConsole {
-		consoleOutput = true
+	//Special values
+	switch strings.ToLower(text) {
+	case "inf", "infinity":
+		return math.Inf(int(sign)), nil
+	case "nan":
+		return math.NaN(), nil
 	}
 
-	//Start executing it
-	success := true
-	program, success = parser.ParseProgram(string(file))
-	if success {
+	//Integers in other bases
+	bases := map[byte]int{'x': 16, 'o': 8, 'b': 2}
+	if len(text) >= 2 && text[0] == '0' && bases[text[1]|0x20] != 0 {
+		base := bases[text[1]|0x20]
+		digits := text[2:]
+		if digits == "" {
+			return 0, fmt.Errorf("expected digits after '%s'", text[:2])
+		}
+		for _, char := range digits {
+			if _, err := strconv.ParseUint(string(char), base, 64); err != nil {
+				return 0, fmt.Errorf("'%c' is not a base %d digit", char, base)
+			}
+		}
+		number, err := strconv.ParseUint(digits, base, 64)
+		if err != nil {
+			return 0, fmt.Errorf("number is too large")
+		}
+		return sign * float64(number), nil
+	}
 
-		//Run program
-		err = runProgram(program)
+	//Split off exponent
+	mantissa, exponent, hasExponent := text, "", false
+	if i := strings.IndexAny(text, "eE"); i >= 0 {
+		mantissa, exponent, hasExponent = text[:i], text[i+1:], true
+		digits := strings.TrimLeft(exponent, "+-")
+		if len(exponent)-len(digits) > 1 {
+			return 0, fmt.Errorf("more than one sign in exponent")
+		}
+		if digits == "" {
+			return 0, fmt.Errorf("expected digits in exponent")
+		}
+		for _, char := range digits {
+			if char < '0' || char > '9' {
+				return 0, fmt.Errorf("unexpected character '%c' in exponent", char)
+			}
+		}
+	}
 
-		//Handle program output
-		fmt.Println()
-		fmt.Println()
-		if err != nil {
-			//Print error
-			fmt.Println(err.Error())
-		} else {
-			//Program finished :)
-			fmt.Println("Program finished :)")
+	//Check digits and decimal point
+	digits := false
+	point := false
+	for _, char := range mantissa {
+		switch {
+		case char >= '0' && char <= '9':
+			digits = true
+		case char == '.' || char == ',':
+			if point {
+				return 0, fmt.Errorf("more than one decimal point")
+			}
+			point = true
+		default:
+			return 0, fmt.Errorf("unexpected character '%c'", char)
 		}
 	}
+	if !digits {
+		return 0, fmt.Errorf("expected digits")
+	}
 
-	//Close file maybe
-	if writeToFile {
-		outputFile.Close()
+	//Convert it
+	decimal := strings.Replace(mantissa, ",", ".", 1)
+	if hasExponent {
+		decimal += "e" + exponent
 	}
+	number, err := strconv.ParseFloat(decimal, 64)
+	if err != nil {
+		return 0, fmt.Errorf("number is out of range")
+	}
+	return sign * number, nil
+}
+
+//Clear memory and input position before a run
+func resetRuntime() {
+	memory = make(map[float64]float64)
+	inputPos = 0
 }
 
 //Read from memory
@@ -382,29 +644,112 @@ func memoryRead(pos float64) float64 {
 
 //Main program function
 func runProgram(program []float64) error {
+	return runProgramAt(program, 0)
+}
+
+//Run a program starting at the given position, used by the REPL to run only what was just added
+func runProgramAt(program []float64, start int) error {
+
+	//Tracing
+	var event traceEvent
+	var traceOut *bufio.Writer
+	if tracing {
+		traceOut = bufio.NewWriter(traceOutput)
+		defer traceOut.Flush()
+	}
+
+	//Memory access, recorded when tracing
+	read := func(pos float64) float64 {
+		val := memoryRead(pos)
+		if tracing {
+			event.reads = append(event.reads, traceValue{pos, val})
+		}
+		return val
+	}
+	write := func(pos float64, val float64) {
+		memory[pos] = val
+		if tracing {
+			event.writes = append(event.writes, traceValue{pos, val})
+		}
+	}
 
-	callstack := make([]int, 0, 64)
-	for readPos := 0; readPos < len(program); {
+	//Stop with an error, making sure the failing instruction is traced
+	fail := func(err error) error {
+		if tracing {
+			event.write(traceOut, traceFormat)
+		}
+		return err
+	}
 
+	//Find every function, so calls can be checked
+	functions := make(map[int]bool)
+	for pos := 0; pos < len(program); pos = nextInstruction(program, pos) {
+		if token.Token(program[pos]) == token.FunctionStart {
+			functions[pos] = true
+		}
+	}
+
+	//Resolve a righthand, chained like the lefthand
+	readPos := start
+	operand := func() float64 {
+		address := program[readPos+1]
+		readPos += 2
+		for readPos < len(program) && isChain(token.Token(program[readPos])) {
+			if token.Token(program[readPos]) == token.ChainMinus {
+				address -= read(program[readPos+2])
+			} else {
+				address += read(program[readPos+2])
+			}
+			readPos += 3
+		}
+		return address
+	}
+
+	callstack := make([]callFrame, 0, 64)
+	steps := 0
+	for readPos < len(program) {
+
+		//Has the program run for too long?
+		steps++
+		if maxSteps != 0 && steps > maxSteps {
+			return limitError{fmt.Sprintf("step limit exceeded: executed %d instructions, at line %d", maxSteps, lineAt(readPos))}
+		}
+
+		instructionPos := readPos
 		tok := token.Token(program[readPos])
 		readPos++
+		if tracing {
+			event.reset(instructionPos, lineAt(instructionPos))
+			event.op = tok.GetTokenName()
+		}
+		if profiling {
+			profileStep(instructionPos)
+		}
+		if covering {
+			coverStep(instructionPos)
+		}
+
 		switch tok {
 
-		//End of function (return)
-		case token.FunctionEnd:
+		//End of function, or returning early
+		case token.FunctionEnd, token.Return:
 			if len(callstack) == 0 {
-				return fmt.Errorf("empty call stack, can't return from function")
+				return fail(fmt.Errorf("empty call stack, can't return from function"))
 			}
 
-			readPos = callstack[len(callstack)-1]
+			readPos = callstack[len(callstack)-1].returnPos
 			callstack = callstack[:len(callstack)-1]
+			event.jump = readPos
+			if profiling {
+				profileReturn()
+			}
 
 		//Jump indicator
-		case token.FunctionStart, token.SquareEnd:
+		case token.FunctionStart, token.SquareEnd, token.Else, token.Break, token.Continue:
 
 			//Read jump point and jump
 			readPos = int(program[readPos])
-			continue
+			event.jump = readPos
 
 		//It's a number
 		case token.Number:
@@ -424,149 +769,144 @@ func runProgram(program []float64) error {
 
 				//Chain lefthand
 				if tok == token.ChainMinus {
-					lefthand -= memoryRead(program[readPos])
+					lefthand -= read(program[readPos])
 				} else {
-					lefthand += memoryRead(program[readPos])
+					lefthand += read(program[readPos])
 				}
 				readPos++
 			}
 
+			//Lefthand is resolved
+			if tracing {
+				event.op = tok.GetTokenName()
+				event.hasAddress = true
+				event.address = lefthand
+			}
+
 			//We got us an operation
 			switch tok {
 			case token.Increment:
-				memory[lefthand] = memoryRead(lefthand) + 1
+				write(lefthand, read(lefthand)+1)
 			case token.Decrement:
-				memory[lefthand] = memoryRead(lefthand) - 1
+				write(lefthand, read(lefthand)-1)
+			case token.Floor:
+				write(lefthand, math.Floor(read(lefthand)))
+			case token.Ceil:
+				write(lefthand, math.Ceil(read(lefthand)))
+			case token.Round:
+				write(lefthand, math.Round(read(lefthand)))
+			case token.Abs:
+				write(lefthand, math.Abs(read(lefthand)))
+			case token.Negate:
+				write(lefthand, -read(lefthand))
+			case token.Sqrt:
+				write(lefthand, math.Sqrt(read(lefthand)))
 
 			case token.Assign:
-				readPos++
-				righthand := program[readPos]
-				readPos++
-				memory[lefthand] = memoryRead(righthand)
+				righthand := operand()
+				write(lefthand, read(righthand))
 			case token.Add:
-				readPos++
-				righthand := program[readPos]
-				readPos++
-				memory[lefthand] = memoryRead(lefthand) + memoryRead(righthand)
+				righthand := operand()
+				write(lefthand, read(lefthand)+read(righthand))
 			case token.Sub:
-				readPos++
-				righthand := program[readPos]
-				readPos++
-				memory[lefthand] = memoryRead(lefthand) - memoryRead(righthand)
+				righthand := operand()
+				write(lefthand, read(lefthand)-read(righthand))
 			case token.Multiply:
-				readPos++
-				righthand := program[readPos]
-				readPos++
-				memory[lefthand] = memoryRead(lefthand) * memoryRead(righthand)
+				righthand := operand()
+				write(lefthand, read(lefthand)*read(righthand))
 			case token.Divide:
-				readPos++
-				righthand := program[readPos]
-				readPos++
-				memory[lefthand] = memoryRead(lefthand) / memoryRead(righthand)
-
-			case token.PrintChar:
-				if consoleOutput {
-					fmt.Print(string(byte(memoryRead(lefthand))))
-				}
-				if writeToFile {
-					outputFile.Write([]byte{(byte(memoryRead(lefthand)))})
-				}
-			case token.PrintNumber:
-				if consoleOutput {
-					fmt.Print(memoryRead(lefthand))
+				righthand := operand()
+				write(lefthand, read(lefthand)/read(righthand))
+			case token.FloorDivide:
+				righthand := operand()
+				write(lefthand, math.Floor(read(lefthand)/read(righthand)))
+			case token.Modulo:
+				righthand := operand()
+				write(lefthand, floorMod(read(lefthand), read(righthand)))
+			case token.Power:
+				righthand := operand()
+				write(lefthand, math.Pow(read(lefthand), read(righthand)))
+			case token.BitAnd, token.BitOr, token.BitXor, token.ShiftLeft, token.ShiftRight:
+				righthand := operand()
+				val, err := bitwise(tok, read(lefthand), read(righthand))
+				if err != nil {
+					return fail(fmt.Errorf("%s, at line %d", err.Error(), lineAt(instructionPos)))
 				}
-				if writeToFile {
-					outputFile.WriteString(fmt.Sprint(memoryRead(lefthand)))
+				write(lefthand, val)
+
+			case token.PrintChar, token.PrintNumber:
+				if err := printValue(tok, read(lefthand)); err != nil {
+					return fail(fmt.Errorf("%s, at line %d", err.Error(), lineAt(instructionPos)))
 				}
 			case token.ReadInput:
 				//Read value
 				val, err := getInput()
 				if err != nil {
-					return err
+					return fail(fmt.Errorf("%s, at line %d", err.Error(), lineAt(instructionPos)))
 				}
 
 				//Assign it to memory
-				memory[lefthand] = val
+				write(lefthand, val)
 
-			case token.Equals:
-				readPos++
-				righthand := memoryRead(program[readPos])
-				readPos++
-				if memoryRead(lefthand) == righthand {
-					readPos++
-				} else {
-					//Jump
-					readPos = int(program[readPos])
-				}
-			case token.Different:
-				readPos++
-				righthand := memoryRead(program[readPos])
-				readPos++
-				if memoryRead(lefthand) != righthand {
-					readPos++
-				} else {
-					//Jump
-					readPos = int(program[readPos])
-				}
-			case token.LessThan:
-				readPos++
-				righthand := memoryRead(program[readPos])
-				readPos++
-				if memoryRead(lefthand) < righthand {
-					readPos++
-				} else {
-					//Jump
-					readPos = int(program[readPos])
-				}
-			case token.LessEquals:
-				readPos++
-				righthand := memoryRead(program[readPos])
-				readPos++
-				if memoryRead(lefthand) <= righthand {
-					readPos++
-				} else {
-					//Jump
-					readPos = int(program[readPos])
-				}
-			case token.GreaterThan:
-				readPos++
-				righthand := memoryRead(program[readPos])
-				readPos++
-				if memoryRead(lefthand) > righthand {
+			case token.Equals, token.Different, token.LessThan, token.LessEquals, token.GreaterThan, token.GreaterEquals:
+				righthand := read(operand())
+				taken := compare(tok, read(lefthand), righthand)
+				if taken {
 					readPos++
+					event.branch = "taken"
 				} else {
 					//Jump
 					readPos = int(program[readPos])
+					event.branch = "not taken"
+					event.jump = readPos
 				}
-			case token.GreaterEquals:
-				readPos++
-				righthand := memoryRead(program[readPos])
-				readPos++
-				if memoryRead(lefthand) >= righthand {
-					readPos++
-				} else {
-					//Jump
-					readPos = int(program[readPos])
+				if covering {
+					coverBranch(instructionPos, taken)
 				}
 
 			case token.FunctionRun:
 
+				//Is there room for another call?
+				if maxCallDepth != 0 && len(callstack) >= maxCallDepth {
+					return fail(stackOverflow(callstack, instructionPos))
+				}
+
+				//Verify function
+				target := read(lefthand)
+				entry := int(target)
+				if float64(entry) != target || !functions[entry] {
+					return fail(fmt.Errorf("error: invalid function call"))
+				}
+
 				//Push current position onto program stack
-				callstack = append(callstack, readPos)
-				if len(callstack) == 32 {
-					fmt.Println("warning: callstack is big")
+				callstack = append(callstack, callFrame{
+					returnPos: readPos,
+					function:  lefthand,
+					entry:     entry,
+				})
+				if len(callstack) == callstackWarning {
+					fmt.Fprintln(errorOutput, "warning: callstack is big")
 				}
 
-				//Move read position and verify function
-				readPos = int(memoryRead(lefthand))
-				if program[readPos] != float64(token.FunctionStart) {
-					return fmt.Errorf("error: invalid function call")
+				//Move read position
+				readPos = entry + 2
+				event.jump = readPos
+				if profiling {
+					profileCall(instructionPos, entry)
 				}
-				readPos += 2
 
 			default:
-				return fmt.Errorf("unknown operation '%s'", tok.GetTokenName())
+				return fail(fmt.Errorf("unknown operation '%s'", tok.GetTokenName()))
 			}
+
+		//Only made by broken bytecode
+		default:
+			return fail(fmt.Errorf("unknown instruction '%s', at line %d", tok.GetTokenName(), lineAt(instructionPos)))
+		}
+
+		//Instruction done
+		if tracing {
+			event.write(traceOut, traceFormat)
 		}
 	}
 
@@ -574,16 +914,149 @@ func runProgram(program []float64) error {
 	return nil
 }
 
-//Prints program usage
-func printUsage() {
-	fmt.Println("Usage: numskull [-i file] [-t] [-o file] [-c] <program-file>")
-	fmt.Println("Useful options:")
-	fmt.Println("\t", usage_h)
-	fmt.Println("\t", usage_v)
-	fmt.Println("\t", usage_i)
-	fmt.Println("\t", usage_t)
-	fmt.Println("\t", usage_o)
-	fmt.Println("\t", usage_c)
+//Evaluate a comparison operation
+func compare(tok token.Token, lefthand float64, righthand float64) bool {
+	switch tok {
+	case token.Equals:
+		return lefthand == righthand
+	case token.Different:
+		return lefthand != righthand
+	case token.LessThan:
+		return lefthand < righthand
+	case token.LessEquals:
+		return lefthand <= righthand
+	case token.GreaterThan:
+		return lefthand > righthand
+	case token.GreaterEquals:
+		return lefthand >= righthand
+	}
+	return false
+}
+
+//Bitwise operation on the int64 values of both operands.
+//Both must be whole numbers, and shifts can't be negative.
+func bitwise(tok token.Token, lefthand float64, righthand float64) (float64, error) {
+	for _, val := range []float64{lefthand, righthand} {
+		if val != math.Trunc(val) || val < math.MinInt64 || val >= math.MaxInt64 {
+			return 0, fmt.Errorf("can't use %s in '%s', it must be a whole number", formatTraceNumber(val), tok.GetTokenName())
+		}
+	}
+	left, right := int64(lefthand), int64(righthand)
+
+	switch tok {
+	case token.BitAnd:
+		return float64(left & right), nil
+	case token.BitOr:
+		return float64(left | right), nil
+	case token.BitXor:
+		return float64(left ^ right), nil
+	}
+
+	//Shifts
+	if right < 0 {
+		return 0, fmt.Errorf("can't shift by %d, it must be 0 or more", right)
+	}
+	if tok == token.ShiftLeft {
+		return float64(left << uint64(right)), nil
+	}
+	return float64(left >> uint64(right)), nil
+}
+
+//Remainder of a division rounded down, which has the same sign as the divisor
+func floorMod(lefthand float64, righthand float64) float64 {
+	rem := math.Mod(lefthand, righthand)
+	if rem != 0 && (rem < 0) != (righthand < 0) {
+		rem += righthand
+	}
+	return rem
+}
+
+//Position of the instruction after the one at pos
+func nextInstruction(program []float64, pos int) int {
+	switch token.Token(program[pos]) {
+
+	//Function end and return are alone
+	case token.FunctionEnd, token.Return:
+		return pos + 1
+
+	//Jumps carry their destination
+	case token.FunctionStart, token.SquareEnd, token.Else, token.Break, token.Continue:
+		return pos + 2
+
+	//Lefthand, chain, operation and operands
+	case token.Number:
+		pos = chainEnd(program, pos+2)
+		switch token.Token(program[pos]) {
+		case token.Assign, token.Add, token.Sub, token.Multiply, token.Divide, token.FloorDivide, token.Modulo, token.Power,
+			token.BitAnd, token.BitOr, token.BitXor, token.ShiftLeft, token.ShiftRight:
+			return chainEnd(program, pos+3)
+		case token.Equals, token.Different, token.LessThan, token.LessEquals, token.GreaterThan, token.GreaterEquals:
+			return chainEnd(program, pos+3) + 1
+		default:
+			return pos + 1
+		}
+	}
+
+	//Unknown, skip a single value
+	return pos + 1
+}
+
+//Position after the chain starting at pos, if there is one
+func chainEnd(program []float64, pos int) int {
+	for pos < len(program) && isChain(token.Token(program[pos])) {
+		pos += 3
+	}
+	return pos
+}
+
+//Is this a + or - chaining a number?
+func isChain(tok token.Token) bool {
+	return tok == token.ChainPlus || tok == token.ChainMinus
+}
+
+//Source line of a program position, 0 if unknown
+func lineAt(pos int) int {
+	if pos < 0 || pos >= len(programLines) {
+		return 0
+	}
+	return programLines[pos]
+}
+
+//Source code of a line, without carriage return
+func sourceLine(line int) string {
+	if line < 1 || line > len(sourceLines) {
+		return ""
+	}
+	return strings.TrimSuffix(sourceLines[line-1], "\r")
+}
+
+//Builds the error for a call that goes past the maximum call depth
+func stackOverflow(callstack []callFrame, callPos int) error {
+	msg := fmt.Sprintf("stack overflow: call depth exceeded %d, at line %d", maxCallDepth, lineAt(callPos))
+
+	//List the most recent frames
+	listed := 0
+	for i := len(callstack) - 1; i >= 0 && listed < overflowFrames; i-- {
+		frame := callstack[i]
+		msg += fmt.Sprintf("\n\tfunction %v (line %d), called from line %d", frame.function, lineAt(frame.entry), lineAt(frame.returnPos-1))
+		listed++
+	}
+
+	//Summarize the rest
+	if len(callstack) > listed {
+		msg += fmt.Sprintf("\n\t... %d more frames", len(callstack)-listed)
+	}
+	return limitError{msg}
+}
+
+//An error from going past --max-steps or --max-call-depth
+type limitError struct {
+	msg string
+}
+
+//The message, same as any other error
+func (err limitError) Error() string {
+	return err.msg
 }
 
 //Get input from file or command line
@@ -603,14 +1076,19 @@ func getInput() (float64, error) {
 
 	} else {
 
+		//The console was used up by the program itself
+		if !consoleInput {
+			return 0, errors.New("can't read input from the console, since the program was read from stdin; use -i to read input from a file")
+		}
+
 		//Read input from stdin
 		var str string
-		_, err := fmt.Scan(&str)
+		_, err := fmt.Fscan(stdin, &str)
 		if err != nil {
 			return 0, err
 		}
 
 		//Convert this to float64 and return
-		return utils.BytesliceToNumber([]byte(str))
+		return parseTextNumber(str)
 	}
 }
@@ -0,0 +1,1405 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"numskull/parser"
+	"numskull/token"
+)
+
+//Run a program with text input, return output and error
+func runSource(src string, in string) (string, error) {
+	output, err := runTestProgram("test.nms", []byte(src), []byte(in), false)
+	return string(output), err
+}
+
+//Parse a program and make it the loaded one, until the test ends
+func loadTestSource(t *testing.T, src string) []float64 {
+	t.Helper()
+	prog, diagnostics := parser.Parse([]byte(src))
+	if len(diagnostics) != 0 {
+		t.Fatalf("program did not parse: %v", diagnostics)
+	}
+	oldProgram, oldLines, oldPath, oldSource, oldWriter := program, programLines, programPath, sourceLines, consoleWriter
+	t.Cleanup(func() {
+		program, programLines, programPath, sourceLines, consoleWriter = oldProgram, oldLines, oldPath, oldSource, oldWriter
+	})
+	program, programLines, programPath = prog.Code, prog.Lines, "test.nms"
+	sourceLines = strings.Split(src, "\n")
+	consoleWriter = io.Discard
+	resetRuntime()
+	return prog.Code
+}
+
+func TestRunProgram(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		input   string
+		want    string
+		wantErr string
+	}{
+		{name: "number contains itself", src: "5!", want: "5"},
+		{name: "increment", src: "5++\n5!", want: "6"},
+		{name: "decrement", src: "5--\n5!", want: "4"},
+		{name: "assign", src: "1 = 60\n1!", want: "60"},
+		{name: "assign copies value", src: "2 = 7\n1 = 2\n1!", want: "7"},
+		{name: "add", src: "5 += 2\n5!", want: "7"},
+		{name: "subtract", src: "5 -= 2\n5!", want: "3"},
+		{name: "multiply", src: "5 *= 3\n5!", want: "15"},
+		{name: "divide", src: "5 /= 2\n5!", want: "2.5"},
+		{name: "divide by zero", src: "0 /= 0\n0!", want: "NaN"},
+		{name: "floor divide", src: "7 \\= 2\n7!\n-7 \\= 2\n32#\n-7!", want: "3 -4"},
+		{name: "floor divide by zero", src: "7 \\= 0\n7!", want: "Inf"},
+		{name: "modulo", src: "7 %= 3\n7!\n-7 %= 3\n32#\n-7!\n8 %= -3\n32#\n8!", want: "1 2 -1"},
+		{name: "modulo fraction", src: "5.5 %= 2\n5.5!", want: "1.5"},
+		{name: "modulo by zero", src: "7 %= 0\n7!", want: "NaN"},
+		{name: "modulo infinity", src: "1 = 1\n1 /= 0\n-2 %= 1\n-2!", want: "Inf"},
+		{name: "power", src: "2 ^= 10\n2!\n4 ^= 0.5\n32#\n4!", want: "1024 2"},
+		{name: "power negative", src: "2 ^= -1\n2!\n-8 ^= 0.5\n32#\n-8!", want: "0.5 NaN"},
+		{name: "bitwise and", src: "12 &= 10\n12!", want: "8"},
+		{name: "bitwise or", src: "12 |= 3\n12!", want: "15"},
+		{name: "bitwise xor", src: "5 ~= 3\n5!\n-1 ~= 0\n32#\n-1!", want: "6 -1"},
+		{name: "shift left", src: "1 <<= 10\n1!", want: "1024"},
+		{name: "shift right", src: "1024 >>= 3\n1024!\n-16 >>= 2\n32#\n-16!", want: "128 -4"},
+		{name: "shift past width", src: "1 <<= 64\n1!\n-1 >>= 64\n32#\n-1!", want: "0 -1"},
+		{name: "bitwise fraction", src: "1.5 &= 1", wantErr: "can't use 1.5 in '&=', it must be a whole number, at line 1"},
+		{name: "bitwise nan", src: "0 /= 0\n1 |= 0", wantErr: "can't use NaN in '|='"},
+		{name: "bitwise infinity", src: "1 /= 0\n2 ~= 1", wantErr: "can't use +Inf in '~='"},
+		{name: "bitwise too large", src: "1 = 2\n1 ^= 63\n1 &= 1", wantErr: "can't use 9.223372036854776e+18 in '&='"},
+		{name: "shift negative", src: "1 <<= -1", wantErr: "can't shift by -1, it must be 0 or more"},
+		{name: "shift function bracket", src: "1 = <\n1 >>= 2\n>\n1()\n1!", want: "1"},
+		{name: "floor", src: "1 = 2.7\n1_\n1!\n2 = -2.2\n2_\n32#\n2!", want: "2 -3"},
+		{name: "ceil", src: "1 = 2.2\n1^\n1!\n2 = -2.7\n2^\n32#\n2!", want: "3 -2"},
+		{name: "round", src: "1 = 2.5\n1~\n1!\n2 = -2.5\n2~\n32#\n2!\n3 = 2.49\n3~\n32#\n3!", want: "3 -3 2"},
+		{name: "abs", src: "-4||\n-4!\n4||\n32#\n4!", want: "4 4"},
+		{name: "negate", src: "4+-\n4!\n-4+-\n32#\n-4!", want: "-4 4"},
+		{name: "sqrt", src: "16_/\n16!\n2_/\n2 ^= 2\n32#\n2~\n2!", want: "4 2"},
+		{name: "sqrt negative", src: "-4_/\n-4!", want: "NaN"},
+		{name: "unary infinity", src: "1 /= 0\n2 = 1\n2+-\n1_\n1~\n2^\n2||\n1_/\n1!\n32#\n2!", want: "Inf Inf"},
+		{name: "unary nan", src: "0 /= 0\n0_\n0^\n0~\n0||\n0+-\n0_/\n0!", want: "NaN"},
+		{name: "print char", src: "72#\n105#", want: "Hi"},
+		{name: "print unicode", src: "233#\n128512#", want: "é😀"},
+		{name: "print negative char", src: "-1#", wantErr: "can't print -1 as a character"},
+		{name: "print fractional char", src: "1 = 65.5\n1#", wantErr: "can't print 65.5 as a character"},
+		{name: "print surrogate", src: "55296#", wantErr: "can't print 55296 as a character"},
+		{name: "print nan char", src: "0 /= 0\n0#", wantErr: "can't print NaN as a character"},
+		{name: "read input", src: "1\"\n1!\n2\"\n2!", input: "3 -4.5", want: "3-4.5"},
+		{name: "read past end", src: "1\"\n1\"\n1!", input: "3", want: "-1"},
+		{name: "chain plus", src: "1 = 10\n6+1!", want: "16"},
+		{name: "chain twice", src: "1 = 10\n6+1+7!", want: "23"},
+		{name: "chain write", src: "1 = 10\n0+1 = 3\n10!", want: "3"},
+		{name: "chain righthand", src: "1 = 10\n16 = 5\n2 = 6+1\n2!", want: "5"},
+		{name: "chain righthand minus", src: "1 = 3\n7 = 4\n2 = 10 - 1\n2 += 10 - 1\n2!", want: "8"},
+		{name: "chain righthand twice", src: "1 = 2\n8 = 9\n2 = 5+1+1\n2!", want: "9"},
+		{name: "chain both sides", src: "1 = 1\n21 = 7\n10+1 = 20+1\n11!", want: "7"},
+		{name: "chain comparison", src: "1 = 2\n12 = 5\n5 ?= 10+1 {\n7!\n}\n5 ?! 10+1 {\n8!\n}", want: "7"},
+		{name: "chain loop", src: "1 = 3\n0 = 0\n0 ?< 0+1 [\n0!\n0++\n]", want: "012"},
+		{name: "equals taken", src: "1 ?= 1 {\n7!\n}\n8!", want: "78"},
+		{name: "equals skipped", src: "1 ?= 2 {\n7!\n}\n8!", want: "8"},
+		{name: "else skipped", src: "1 ?= 1 {\n7!\n} {\n8!\n}\n9!", want: "79"},
+		{name: "else taken", src: "1 ?= 2 {\n7!\n} {\n8!\n}\n9!", want: "89"},
+		{name: "else nested", src: "1 ?= 2 {\n7!\n} {\n2 ?= 2 {\n8!\n} {\n9!\n}\n}", want: "8"},
+		{name: "break", src: "0 ?< 9 [\n0 ?= 3 {\n>]\n}\n0!\n0++\n]\n7!", want: "0127"},
+		{name: "continue", src: "0 ?< 5 [\n0++\n0 ?= 3 {\n[<\n}\n0!\n]", want: "1245"},
+		{name: "break nested loop", src: "0 ?< 2 [\n1 = 0\n1 ?< 9 [\n1 ?= 2 {\n>]\n}\n1!\n1++\n]\n0++\n]", want: "011"},
+		{name: "break in function", src: "1 = <\n0 ?< 9 [\n0 ?= 2 {\n>]\n}\n0++\n]\n0!\n>\n1()", want: "2"},
+		{name: "else in loop", src: "0 ?< 4 [\n0 ?< 2 {\n1!\n} {\n2!\n}\n0++\n]", want: "1122"},
+		{name: "different", src: "1 ?! 2 {\n7!\n}", want: "7"},
+		{name: "less than", src: "1 ?< 2 {\n7!\n}\n2 ?< 1 {\n8!\n}", want: "7"},
+		{name: "less equals", src: "2 ?<= 2 {\n7!\n}\n3 ?<= 2 {\n8!\n}", want: "7"},
+		{name: "greater than", src: "2 ?> 1 {\n7!\n}\n1 ?> 2 {\n8!\n}", want: "7"},
+		{name: "greater equals", src: "2 ?>= 2 {\n7!\n}\n1 ?>= 2 {\n8!\n}", want: "7"},
+		{name: "loop", src: "1 = 3\n1 ?> 0 [\n1!\n1--\n]", want: "321"},
+		{name: "nan never equal", src: "0 /= 0\n0 ?= 0 {\n7!\n}", want: ""},
+		{name: "function", src: "1 = <\n9!\n>\n1()\n1()", want: "99"},
+		{name: "nested function", src: "1 = <\n8!\n>\n2 = <\n1()\n9!\n>\n2()", want: "89"},
+		{name: "return early", src: "1 = <\n8!\n>>\n9!\n>\n1()\n7!", want: "87"},
+		{name: "return from loop", src: "1 = <\n0 ?< 9 [\n0 ?= 3 {\n>>\n}\n0!\n0++\n]\n7!\n>\n1()\n8!", want: "0128"},
+		{name: "return nested call", src: "1 = <\n8!\n>>\n>\n2 = <\n1()\n9!\n>>\n6!\n>\n2()\n7!", want: "897"},
+		{name: "call non-function", src: "1()", wantErr: "invalid function call"},
+		{name: "call fractional", src: "1 = <\n>\n2 = 1\n2 += 0.5\n2()", wantErr: "invalid function call"},
+		{name: "call nan", src: "0 /= 0\n0()", wantErr: "invalid function call"},
+		{name: "call out of range", src: "1000000()", wantErr: "invalid function call"},
+		{name: "call negative", src: "-5()", wantErr: "invalid function call"},
+	}
+
+	for _, test := range tests {
+		got, err := runSource(test.src, test.input)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: error = %v, want %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: output = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCallDepthLimit(t *testing.T) {
+	old := maxCallDepth
+	defer func() { maxCallDepth = old }()
+	maxCallDepth = 10
+
+	_, err := runSource("1 = <\n1()\n>\n1()", "")
+	if err == nil || !strings.Contains(err.Error(), "stack overflow") {
+		t.Fatalf("error = %v, want stack overflow", err)
+	}
+	if !strings.Contains(err.Error(), "called from line 2") {
+		t.Errorf("error does not list frames: %v", err)
+	}
+}
+
+func TestStepLimit(t *testing.T) {
+	old := maxSteps
+	defer func() { maxSteps = old }()
+	maxSteps = 100
+
+	_, err := runSource("1 ?= 1 [\n]", "")
+	if err == nil || !strings.Contains(err.Error(), "step limit exceeded") {
+		t.Fatalf("error = %v, want step limit exceeded", err)
+	}
+
+	//Programs under the limit are fine
+	got, err := runSource("1 = 3\n1 ?> 0 [\n1--\n]\n1!", "")
+	if err != nil || got != "0" {
+		t.Errorf("output = %q, %v, want \"0\"", got, err)
+	}
+}
+
+func TestTestStepLimit(t *testing.T) {
+	old := testMaxSteps
+	defer func() { testMaxSteps = old }()
+	testMaxSteps = 100
+
+	//Tests get a limit even when none is set, and the setting is left alone
+	_, err := runSource("1 ?= 1 [\n]", "")
+	if err == nil || !strings.Contains(err.Error(), "step limit exceeded: executed 100 instructions") {
+		t.Fatalf("error = %v, want step limit exceeded", err)
+	}
+	if maxSteps != 0 {
+		t.Errorf("maxSteps = %d after the test, want 0", maxSteps)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	//A chained address, a call and return, a branch taken and not taken, and a JSON infinity
+	src := "1 = <\n3++\n>\n2 = 3\n0+2 ?= 3 {\n1()\n}\n4 ?= 5 {\n4!\n}\n6 /= 0"
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{traceText, `     0  line 1    =    @1  read [5]=5  write [1]=5
+     5  line 1    <    -> 11
+    11  line 4    =    @2  read [3]=3  write [2]=3
+    16  line 5    ?=   @3  read [2]=3 [3]=3 [3]=3  taken
+    25  line 6    ()   @1  read [1]=5  -> 7
+     7  line 2    ++   @3  read [3]=3  write [3]=4
+    10  line 3    >    -> 28
+    28  line 8    ?=   @4  read [5]=5 [4]=4  not taken  -> 37
+    37  line 11   /=   @6  read [6]=6 [0]=0  write [6]=+Inf
+`},
+		{traceJSON, `{"offset":0,"line":1,"op":"=","address":1,"reads":[{"address":5,"value":5}],"writes":[{"address":1,"value":5}]}
+{"offset":5,"line":1,"op":"<","jump":11}
+{"offset":11,"line":4,"op":"=","address":2,"reads":[{"address":3,"value":3}],"writes":[{"address":2,"value":3}]}
+{"offset":16,"line":5,"op":"?=","address":3,"reads":[{"address":2,"value":3},{"address":3,"value":3},{"address":3,"value":3}],"branch":"taken"}
+{"offset":25,"line":6,"op":"()","address":1,"reads":[{"address":1,"value":5}],"jump":7}
+{"offset":7,"line":2,"op":"++","address":3,"reads":[{"address":3,"value":3}],"writes":[{"address":3,"value":4}]}
+{"offset":10,"line":3,"op":">","jump":28}
+{"offset":28,"line":8,"op":"?=","address":4,"reads":[{"address":5,"value":5},{"address":4,"value":4}],"branch":"not taken","jump":37}
+{"offset":37,"line":11,"op":"/=","address":6,"reads":[{"address":6,"value":6},{"address":0,"value":0}],"writes":[{"address":6,"value":"+Inf"}]}
+`},
+	}
+
+	oldTracing, oldFormat, oldOutput := tracing, traceFormat, traceOutput
+	defer func() { tracing, traceFormat, traceOutput = oldTracing, oldFormat, oldOutput }()
+	for _, test := range tests {
+		code := loadTestSource(t, src)
+		var out strings.Builder
+		tracing, traceFormat, traceOutput = true, test.format, &out
+		if err := runProgram(code); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.want {
+			t.Errorf("%s trace:\n%s\nwant:\n%s", test.format, out.String(), test.want)
+		}
+	}
+}
+
+func TestCoverageFile(t *testing.T) {
+	dir := t.TempDir()
+	src := "1 = 2\n1 ?> 0 [\n1--\n]\n5 ?= 6 {\n5!\n}"
+	code := loadTestSource(t, src)
+	programPath = dir + "/cover.nms"
+	if err := os.WriteFile(programPath, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := covering
+	defer func() { covering = old }()
+	covering = true
+	coverReset()
+	if err := runProgram(code); err != nil {
+		t.Fatal(err)
+	}
+
+	//Write, with conditions listing how often they were taken and skipped
+	path := dir + "/cover.out"
+	if err := writeCoverage(path); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "mode: numskull\n" +
+		programPath + ":1 1\n" +
+		programPath + ":2 3 2 1\n" +
+		programPath + ":3 2\n" +
+		programPath + ":4 2\n" +
+		programPath + ":5 1 0 1\n" +
+		programPath + ":6 0\n"
+	if string(raw) != want {
+		t.Fatalf("coverage file:\n%s\nwant:\n%s", raw, want)
+	}
+
+	//Read it back
+	files, err := readCoverage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].path != programPath {
+		t.Fatalf("read %d files", len(files))
+	}
+	wantLines := map[int]coverEntry{
+		1: {count: 1},
+		2: {count: 3, condition: true, taken: 2, skipped: 1},
+		3: {count: 2},
+		4: {count: 2},
+		5: {count: 1, condition: true, taken: 0, skipped: 1},
+		6: {count: 0},
+	}
+	gotLines := make(map[int]coverEntry)
+	for line, entry := range files[0].lines {
+		gotLines[line] = *entry
+	}
+	if !reflect.DeepEqual(gotLines, wantLines) {
+		t.Errorf("entries = %+v, want %+v", gotLines, wantLines)
+	}
+	lines, conditions := files[0].summary()
+	if math.Abs(lines-100*5/6.0) > 1e-9 || conditions != 50 {
+		t.Errorf("summary = %v%% lines, %v%% conditions", lines, conditions)
+	}
+
+	//HTML marks lines that ran, didn't run, and conditions that only went one way
+	var html strings.Builder
+	if err := writeCoverageHTML(&html, files); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range []string{
+		`<tr class="hit" title="executed 1 times"><td class="num">1</td><td class="num">1</td><td class="src">1 = 2</td></tr>`,
+		`<tr class="hit" title="taken 2, skipped 1"><td class="num">2</td>`,
+		`<tr class="partial" title="taken 0, skipped 1"><td class="num">5</td>`,
+		`<tr class="miss" title="not executed"><td class="num">6</td><td class="num">0</td>`,
+		`<tr class="" title=""><td class="num">7</td><td class="num"></td><td class="src">}</td></tr>`,
+	} {
+		if !strings.Contains(html.String(), row) {
+			t.Errorf("HTML is missing %s", row)
+		}
+	}
+}
+
+func TestIsCondition(t *testing.T) {
+	prog, diagnostics := parser.Parse([]byte("1 = <\n0+1 ?< 2 [\n]\n>\n3 = 0+1\n4 ?! 5 {\n}\n4!"))
+	if len(diagnostics) != 0 {
+		t.Fatalf("program did not parse: %v", diagnostics)
+	}
+	got := make([]bool, 0, 8)
+	for pos := 0; pos < len(prog.Code); pos = nextInstruction(prog.Code, pos) {
+		got = append(got, isCondition(prog.Code, pos))
+	}
+	want := []bool{false, false, true, false, false, false, true, false}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("conditions = %v, want %v", got, want)
+	}
+}
+
+func TestReadCoverage(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		file    string
+		wantErr string
+		lines   map[int]coverEntry
+		summary [2]float64
+	}{
+		{
+			name:    "merged lines",
+			file:    "mode: numskull\na.nms:1 2\na.nms:2 1 1 0\na.nms:1 3\r\na.nms:2 0 0 4\n",
+			lines:   map[int]coverEntry{1: {count: 5}, 2: {count: 1, condition: true, taken: 1, skipped: 4}},
+			summary: [2]float64{100, 100},
+		},
+		{
+			name:    "no conditions",
+			file:    "mode: numskull\na.nms:1 2\na.nms:3 0\n",
+			lines:   map[int]coverEntry{1: {count: 2}, 3: {count: 0}},
+			summary: [2]float64{50, 100},
+		},
+		{name: "bad header", file: "mode: set\na.nms:1 2\n", wantErr: "not a numskull coverage file"},
+		{name: "empty", file: "", wantErr: "not a numskull coverage file"},
+		{name: "no colon", file: "mode: numskull\na.nms 2\n", wantErr: ":2: invalid coverage entry 'a.nms 2'"},
+		{name: "three numbers", file: "mode: numskull\na.nms:1 2 3\n", wantErr: "invalid coverage entry"},
+		{name: "not a number", file: "mode: numskull\na.nms:1 2\na.nms:x 2\n", wantErr: ":3: invalid coverage entry 'a.nms:x 2'"},
+	}
+
+	for _, test := range tests {
+		path := dir + "/" + strings.ReplaceAll(test.name, " ", "_") + ".out"
+		if err := os.WriteFile(path, []byte(test.file), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files, err := readCoverage(path)
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("%s: error = %v, want %q", test.name, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if len(files) != 1 || files[0].path != "a.nms" {
+			t.Errorf("%s: read %d files", test.name, len(files))
+			continue
+		}
+		got := make(map[int]coverEntry)
+		for line, entry := range files[0].lines {
+			got[line] = *entry
+		}
+		if !reflect.DeepEqual(got, test.lines) {
+			t.Errorf("%s: entries = %+v, want %+v", test.name, got, test.lines)
+		}
+		if lines, conditions := files[0].summary(); lines != test.summary[0] || conditions != test.summary[1] {
+			t.Errorf("%s: summary = %v, %v, want %v", test.name, lines, conditions, test.summary)
+		}
+	}
+}
+
+//Run a program with profiling on
+func profileSource(t *testing.T, src string) {
+	t.Helper()
+	code := loadTestSource(t, src)
+	old := profiling
+	t.Cleanup(func() { profiling = old })
+	profiling = true
+	profileReset()
+	if err := runProgram(code); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProfileSummary(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       string
+		lines     map[int]int64
+		functions map[string][2]int64
+	}{
+		{
+			name:      "recursive",
+			src:       "1 = <\n2 ?> 0 {\n2--\n1()\n}\n>\n2 = 3\n1()",
+			lines:     map[int]int64{1: 2, 2: 4, 3: 3, 4: 3, 6: 4, 7: 1, 8: 1},
+			functions: map[string][2]int64{"(main)": {4, 18}, "1 = <": {14, 14}},
+		},
+		{
+			name:      "nested calls",
+			src:       "1 = <\n8!\n>\n2 = <\n1()\n1()\n>\n2()",
+			lines:     map[int]int64{1: 2, 2: 2, 3: 2, 4: 2, 5: 1, 6: 1, 7: 1, 8: 1},
+			functions: map[string][2]int64{"(main)": {5, 12}, "1 = <": {4, 4}, "2 = <": {3, 7}},
+		},
+		{
+			name:      "no functions",
+			src:       "1 = 3\n1 ?> 0 [\n1--\n]",
+			lines:     map[int]int64{1: 1, 2: 4, 3: 3, 4: 3},
+			functions: map[string][2]int64{"(main)": {11, 11}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			profileSource(t, test.src)
+			lines, functions := profileSummary()
+			if !reflect.DeepEqual(lines, test.lines) {
+				t.Errorf("lines = %v, want %v", lines, test.lines)
+			}
+
+			//Self and inclusive steps, by name
+			got := make(map[string][2]int64)
+			for _, fun := range functions {
+				got[functionName(fun.entry)] = [2]int64{fun.self, fun.inclusive}
+			}
+			if !reflect.DeepEqual(got, test.functions) {
+				t.Errorf("functions = %v, want %v", got, test.functions)
+			}
+		})
+	}
+}
+
+func TestTextProfile(t *testing.T) {
+	profileSource(t, "1 = <\n2 ?> 0 {\n2--\n1()\n}\n>\n2 = 3\n1()")
+	var out strings.Builder
+	if err := writeTextProfile(&out); err != nil {
+		t.Fatal(err)
+	}
+	want := `Numskull profile: test.nms
+Total steps: 18
+
+Lines
+       steps       %   line  source
+           4  22.22%      2  2 ?> 0 {
+           4  22.22%      6  >
+           3  16.67%      3  2--
+           3  16.67%      4  1()
+           2  11.11%      1  1 = <
+           1   5.56%      7  2 = 3
+           1   5.56%      8  1()
+
+Functions
+        self       %    inclusive       %   line  function
+           4  22.22%           18 100.00%      0  (main)
+          14  77.78%           14  77.78%      1  1 = <
+`
+	if out.String() != want {
+		t.Errorf("profile:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
+
+//A decoded protocol buffer field, either a number or bytes
+type protoField struct {
+	field int
+	value uint64
+	data  []byte
+}
+
+//Read a varint from the start of data, and return what's left
+func readVarint(t *testing.T, data []byte) (uint64, []byte) {
+	t.Helper()
+	var v uint64
+	for shift := 0; ; shift += 7 {
+		if len(data) == 0 {
+			t.Fatal("truncated varint")
+		}
+		b := data[0]
+		data = data[1:]
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v, data
+		}
+	}
+}
+
+//Decode the fields of a protocol buffer message, only varints and length delimited fields
+func decodeProto(t *testing.T, data []byte) []protoField {
+	t.Helper()
+	fields := make([]protoField, 0, 16)
+	for len(data) != 0 {
+		var key, size uint64
+		key, data = readVarint(t, data)
+		field := protoField{field: int(key >> 3)}
+		switch key & 7 {
+		case 0:
+			field.value, data = readVarint(t, data)
+		case 2:
+			size, data = readVarint(t, data)
+			if uint64(len(data)) < size {
+				t.Fatal("truncated field")
+			}
+			field.data, data = data[:size], data[size:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
+
+//Decode a packed list of varints
+func decodePacked(t *testing.T, data []byte) []uint64 {
+	t.Helper()
+	values := make([]uint64, 0, 8)
+	for len(data) != 0 {
+		var v uint64
+		v, data = readVarint(t, data)
+		values = append(values, v)
+	}
+	return values
+}
+
+func TestPprofProfile(t *testing.T) {
+	profileSource(t, "1 = <\n2 ?> 0 {\n2--\n1()\n}\n>\n2 = 3\n1()")
+	var out bytes.Buffer
+	if err := writePprofProfile(&out); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Collect every part of the profile
+	var strs []string
+	var samples [][2][]uint64
+	locations := make(map[uint64][2]uint64)
+	functions := make(map[uint64]uint64)
+	for _, field := range decodeProto(t, raw) {
+		switch field.field {
+		case pprofStringTable:
+			strs = append(strs, string(field.data))
+		case pprofSample:
+			var sample [2][]uint64
+			for _, f := range decodeProto(t, field.data) {
+				if f.field == pprofSampleLocation {
+					sample[0] = decodePacked(t, f.data)
+				} else if f.field == pprofSampleValue {
+					sample[1] = decodePacked(t, f.data)
+				}
+			}
+			samples = append(samples, sample)
+		case pprofLocation:
+			var id uint64
+			var loc [2]uint64
+			for _, f := range decodeProto(t, field.data) {
+				if f.field == pprofLocationId {
+					id = f.value
+				} else if f.field == pprofLocationLine {
+					for _, ln := range decodeProto(t, f.data) {
+						if ln.field == pprofLineFunction {
+							loc[0] = ln.value
+						} else if ln.field == pprofLineLine {
+							loc[1] = ln.value
+						}
+					}
+				}
+			}
+			locations[id] = loc
+		case pprofFunction:
+			var id, name uint64
+			for _, f := range decodeProto(t, field.data) {
+				if f.field == pprofFunctionId {
+					id = f.value
+				} else if f.field == pprofFunctionName {
+					name = f.value
+				}
+			}
+			functions[id] = name
+		}
+	}
+
+	//Steps by function and line of the innermost location, and the deepest stack
+	got := make(map[string]uint64)
+	deepest := 0
+	for _, sample := range samples {
+		if len(sample[1]) != 1 {
+			t.Fatalf("sample has %d values, want 1", len(sample[1]))
+		}
+		loc := locations[sample[0][0]]
+		got[fmt.Sprintf("%s:%d", strs[functions[loc[0]]], loc[1])] += sample[1][0]
+		if len(sample[0]) > deepest {
+			deepest = len(sample[0])
+		}
+	}
+	want := map[string]uint64{
+		"(main):1": 2, "(main):7": 1, "(main):8": 1,
+		"1 = <:2": 4, "1 = <:3": 3, "1 = <:4": 3, "1 = <:6": 4,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("samples = %v, want %v", got, want)
+	}
+
+	//The function is called 4 times deep, below main
+	if deepest != 5 {
+		t.Errorf("deepest stack = %d, want 5", deepest)
+	}
+}
+
+func TestCoverLines(t *testing.T) {
+	prog, diagnostics := parser.Parse([]byte("1 = <\n2++\n>\n1()\n1()\n3 = 2\n3 ?> 0 [\n3--\n]"))
+	if len(diagnostics) != 0 {
+		t.Fatalf("program did not parse: %v", diagnostics)
+	}
+	oldLines, oldCovering, oldWriter := programLines, covering, consoleWriter
+	defer func() { programLines, covering, consoleWriter = oldLines, oldCovering, oldWriter }()
+	programLines, covering, consoleWriter = prog.Lines, true, io.Discard
+	resetRuntime()
+	coverReset()
+	if err := runProgram(prog.Code); err != nil {
+		t.Fatal(err)
+	}
+
+	//Every line counts once per run, however many instructions it holds
+	want := map[int]int64{1: 1, 2: 2, 3: 2, 4: 1, 5: 1, 6: 1, 7: 5, 8: 4, 9: 4}
+	if !reflect.DeepEqual(coverLines, want) {
+		t.Errorf("line counts = %v, want %v", coverLines, want)
+	}
+}
+
+func TestFindTests(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"a.nms":     "1\"\n1!",
+		"a.in":      "A",
+		"a.out":     "65",
+		"c.nms":     "//test: expect \"1\"\n1!\n5!  //test: input \"2\" expect \"3\"",
+		"d.nms":     "//test: binary\n1\"\n1!\n//test: expect \"x\"",
+		"d.in":      "B",
+		"e.nms":     "//test: text\n1!",
+		"e.out":     "1",
+		"f.nms":     "1!",
+		"g.txt":     "//test: expect \"1\"",
+		"h.nms":     "//test: expected \"1\"",
+		"sub/b.nms": "2!",
+		"sub/b.out": "2",
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests, err := findTests(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]string, len(tests))
+	for i, test := range tests {
+		input := "-"
+		if test.input != nil {
+			input = strconv.Quote(*test.input)
+		}
+		got[i] = fmt.Sprintf("%s:%d in=%s out=%s binary=%v input=%s expect=%q err=%v",
+			strings.TrimPrefix(test.program, dir+"/"), test.line,
+			strings.TrimPrefix(test.inputPath, dir+"/"), strings.TrimPrefix(test.outputPath, dir+"/"),
+			test.binary, input, test.expected, test.err)
+	}
+	want := []string{
+		`a.nms:0 in=a.in out=a.out binary=true input=- expect="" err=<nil>`,
+		`c.nms:1 in= out= binary=false input=- expect="1" err=<nil>`,
+		`c.nms:3 in= out= binary=false input="2" expect="3" err=<nil>`,
+		`d.nms:0 in=d.in out=d.out binary=true input=- expect="" err=<nil>`,
+		`d.nms:4 in= out= binary=true input=- expect="x" err=<nil>`,
+		`e.nms:0 in= out=e.out binary=false input=- expect="" err=<nil>`,
+		`h.nms:1 in= out= binary=false input=- expect="" err=unknown test directive 'expected'`,
+		`sub/b.nms:0 in= out=sub/b.out binary=true input=- expect="" err=<nil>`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tests:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestParseTestDirective(t *testing.T) {
+	tests := []struct {
+		text    string
+		input   string
+		want    string
+		wantErr string
+	}{
+		{text: `expect "8"`, input: "-", want: "8"},
+		{text: `input "3 5" expect "8"`, input: "3 5", want: "8"},
+		{text: `expect "8" input "3 5"`, input: "3 5", want: "8"},
+		{text: "  expect\t \"a\\nb\"  ", input: "-", want: "a\nb"},
+		{text: `expect ""`, input: "-", want: ""},
+		{text: `expected "8"`, wantErr: "unknown test directive 'expected'"},
+		{text: `expect 8`, wantErr: "expected quoted string after 'expect'"},
+		{text: `input expect "8"`, wantErr: "expected quoted string after 'input'"},
+		{text: `expect "8`, wantErr: "expected quoted string after 'expect'"},
+		{text: `input "1" input "2" expect "3"`, wantErr: "more than one input"},
+		{text: `expect "1" expect "2"`, wantErr: "more than one expect"},
+		{text: `input "1"`, wantErr: "missing expect"},
+		{text: ``, wantErr: "missing expect"},
+	}
+
+	for _, test := range tests {
+		input, got, err := parseTestDirective(test.text)
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("%q: error = %v, want %q", test.text, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.text, err)
+			continue
+		}
+		gotInput := "-"
+		if input != nil {
+			gotInput = *input
+		}
+		if gotInput != test.input || got != test.want {
+			t.Errorf("%q: input %q, expect %q, want input %q, expect %q", test.text, gotInput, got, test.input, test.want)
+		}
+	}
+}
+
+func TestUpdateTestDirective(t *testing.T) {
+	path := t.TempDir() + "/update.nms"
+	src := "1!  //test: expect \"old\"\r\n//test: input \"5\" expect \"x\"\r\n2!\r\n//test: expect \"last\""
+	if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	input := "5"
+	for _, update := range []struct {
+		test   goldenTest
+		output string
+	}{
+		{goldenTest{program: path, line: 1}, "new\n"},
+		{goldenTest{program: path, line: 2, input: &input}, "y"},
+		{goldenTest{program: path, line: 4}, "\"quoted\""},
+	} {
+		if err := updateTestDirective(update.test, update.output); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//Code before the comment and carriage returns are kept
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "1!  //test: expect \"new\\n\"\r\n//test: input \"5\" expect \"y\"\r\n2!\r\n//test: expect \"\\\"quoted\\\"\""
+	if string(raw) != want {
+		t.Errorf("file = %q, want %q", raw, want)
+	}
+
+	//Lines without a directive are left alone
+	if err := updateTestDirective(goldenTest{program: path, line: 3}, "z"); err == nil || !strings.Contains(err.Error(), "test directive not found on line 3") {
+		t.Errorf("updating line without directive: error %v", err)
+	}
+	if err := updateTestDirective(goldenTest{program: path, line: 9}, "z"); err == nil || !strings.Contains(err.Error(), "line 9 not found") {
+		t.Errorf("updating missing line: error %v", err)
+	}
+	if raw2, _ := os.ReadFile(path); string(raw2) != want {
+		t.Errorf("failed updates changed the file to %q", raw2)
+	}
+}
+
+func TestOutputDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+		got      string
+		want     string
+	}{
+		{"insertion", "a\nc\n", "a\nb\nc\n", "\t--- expected\n\t+++ got\n\t a\n\t+b\n\t c\n"},
+		{"deletion", "a\nb\nc\n", "a\nc\n", "\t--- expected\n\t+++ got\n\t a\n\t-b\n\t c\n"},
+		{"change", "a\nb\n", "a\nx\n", "\t--- expected\n\t+++ got\n\t a\n\t-b\n\t+x\n"},
+		{"missing newline", "a\nb\n", "a\nb", "\t--- expected\n\t+++ got\n\t a\n\t-b\n\t+b  (no newline at end)\n"},
+		{"empty", "", "a", "\t--- expected\n\t+++ got\n\t+a  (no newline at end)\n"},
+	}
+	for _, test := range tests {
+		if got := outputDiff(test.expected, test.got); got != test.want {
+			t.Errorf("%s: diff = %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	//Too big to diff, both outputs are listed
+	expected := strings.Repeat("a\n", 3000)
+	got := strings.Repeat("b\n", 3000)
+	diff := outputDiff(expected, got)
+	want := "\t--- expected\n" + strings.Repeat("\t-a\n", 3000) + "\t+++ got\n" + strings.Repeat("\t+b\n", 3000)
+	if diff != want {
+		t.Errorf("big diff has %d lines, want %d", strings.Count(diff, "\n"), strings.Count(want, "\n"))
+	}
+}
+
+func TestCharModes(t *testing.T) {
+	oldMode, oldInvalid := charMode, invalidChar
+	defer func() { charMode, invalidChar = oldMode, oldInvalid }()
+
+	tests := []struct {
+		mode    string
+		invalid string
+		src     string
+		want    string
+	}{
+		{charUnicode, invalidCharReplace, "-1#\n1114112#\n65#", "\uFFFD\uFFFDA"},
+		{charByte, invalidCharError, "65#\n321#\n-1#", "AA\xff"},
+		{charByte, invalidCharReplace, "0 /= 0\n0#\n1 = 65.5\n1#", "??"},
+	}
+	for _, test := range tests {
+		charMode, invalidChar = test.mode, test.invalid
+		got, err := runSource(test.src, "")
+		if err != nil || got != test.want {
+			t.Errorf("%s/%s %q: output = %q, %v, want %q", test.mode, test.invalid, test.src, got, err, test.want)
+		}
+	}
+}
+
+func TestNumberFormats(t *testing.T) {
+	oldFormat, oldDecimals := numberFormat, numberDecimals
+	defer func() { numberFormat, numberDecimals = oldFormat, oldDecimals }()
+
+	tests := []struct {
+		format  string
+		val     float64
+		want    string
+		wantErr bool
+	}{
+		{"shortest", 1e21, "1000000000000000000000", false},
+		{"shortest", 0.1, "0.1", false},
+		{"shortest", -2.5, "-2.5", false},
+		{"shortest", math.Inf(1), "Inf", false},
+		{"shortest", math.Inf(-1), "-Inf", false},
+		{"shortest", math.NaN(), "NaN", false},
+		{"fixed", 2.5, "2.500000", false},
+		{"fixed:2", 1.0 / 3, "0.33", false},
+		{"fixed:0", 7, "7", false},
+		{"fixed:1", math.NaN(), "NaN", false},
+		{"integer", 1e21, "1000000000000000000000", false},
+		{"integer", -4, "-4", false},
+		{"integer", 2.5, "", true},
+		{"integer", math.Inf(1), "", true},
+		{"scientific", 1500, "1.5e+03", false},
+		{"scientific:3", 1500, "1.500e+03", false},
+	}
+	for _, test := range tests {
+		var err error
+		numberFormat, numberDecimals, err = parseNumberFormat(test.format)
+		if err != nil {
+			t.Fatalf("parseNumberFormat(%q): %v", test.format, err)
+		}
+		got, err := formatOutputNumber(test.val)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("%s %v = %q, %v, want %q", test.format, test.val, got, err, test.want)
+		}
+	}
+
+	//Invalid formats
+	for _, bad := range []string{"", "hex", "fixed:", "fixed:-1", "fixed:x", "integer:2", "shortest:1"} {
+		if _, _, err := parseNumberFormat(bad); err == nil {
+			t.Errorf("parseNumberFormat(%q) should fail", bad)
+		}
+	}
+
+	//Fractions stop the program in integer format
+	numberFormat = numberInteger
+	if _, err := runSource("1 = 5\n1 /= 2\n1!", ""); err == nil || !strings.Contains(err.Error(), "can't print 2.5 as an integer, at line 3") {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestParseTextNumber(t *testing.T) {
+	tests := []struct {
+		entry   string
+		want    float64
+		wantErr string
+	}{
+		{entry: "12", want: 12},
+		{entry: "-2.5", want: -2.5},
+		{entry: "+3", want: 3},
+		{entry: ",5", want: 0.5},
+		{entry: "1,25", want: 1.25},
+		{entry: "5.", want: 5},
+		{entry: "1e6", want: 1e6},
+		{entry: "-2.5E-3", want: -2.5e-3},
+		{entry: "1e+2", want: 100},
+		{entry: "0x1F", want: 31},
+		{entry: "-0xff", want: -255},
+		{entry: "0b101", want: 5},
+		{entry: "0o17", want: 15},
+		{entry: "inf", want: math.Inf(1)},
+		{entry: "-Infinity", want: math.Inf(-1)},
+		{entry: "007", want: 7},
+		{entry: "-", wantErr: "expected digits after sign"},
+		{entry: "1..2", wantErr: "more than one decimal point"},
+		{entry: "5-", wantErr: "unexpected character '-'"},
+		{entry: "abc", wantErr: "unexpected character 'a'"},
+		{entry: ".", wantErr: "expected digits"},
+		{entry: "1e", wantErr: "expected digits in exponent"},
+		{entry: "1e+-2", wantErr: "more than one sign in exponent"},
+		{entry: "1e2.5", wantErr: "unexpected character '.' in exponent"},
+		{entry: "0x", wantErr: "expected digits after '0x'"},
+		{entry: "0b102", wantErr: "'2' is not a base 2 digit"},
+		{entry: "0x1p3", wantErr: "'p' is not a base 16 digit"},
+		{entry: "0x1ffffffffffffffff", wantErr: "number is too large"},
+		{entry: "1e999", wantErr: "number is out of range"},
+	}
+	for _, test := range tests {
+		got, err := parseTextNumber(test.entry)
+		if test.wantErr != "" {
+			if err == nil || err.Error() != test.wantErr {
+				t.Errorf("parseTextNumber(%q) error = %v, want %q", test.entry, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("parseTextNumber(%q) = %v, %v, want %v", test.entry, got, err, test.want)
+		}
+	}
+
+	//NaN is never equal to itself
+	if got, err := parseTextNumber("NaN"); err != nil || !math.IsNaN(got) {
+		t.Errorf("parseTextNumber(\"NaN\") = %v, %v", got, err)
+	}
+}
+
+func TestNumberEncodings(t *testing.T) {
+	for name, enc := range numberEncodings {
+		values := []float64{0, 1, 255, 32767, 65535}
+		if enc.kind != encodingUnsigned {
+			values = []float64{0, 1, -1, 255, 32767, -32768}
+		}
+		if enc.kind == encodingFloat {
+			values = append(values, 0.5, -1.25, math.Inf(1))
+		}
+		raw := []byte{}
+		for _, val := range values {
+			out, err := enc.encode(name, val)
+			if err != nil {
+				t.Fatalf("%s: encode(%v): %v", name, val, err)
+			}
+			if len(out) != enc.size {
+				t.Fatalf("%s: encode(%v) wrote %d bytes", name, val, len(out))
+			}
+			raw = append(raw, out...)
+		}
+		got, err := decodeInput(name, raw)
+		if err != nil || !reflect.DeepEqual(got, values) {
+			t.Errorf("%s: round trip = %v, %v, want %v", name, got, err, values)
+		}
+	}
+
+	//Byte order
+	out, _ := numberEncodings["i16be"].encode("i16be", 258)
+	if !reflect.DeepEqual(out, []byte{1, 2}) {
+		t.Errorf("i16be 258 = %v", out)
+	}
+	out, _ = numberEncodings["f64le"].encode("f64le", 1)
+	if !reflect.DeepEqual(out, []byte{0, 0, 0, 0, 0, 0, 0xf0, 0x3f}) {
+		t.Errorf("f64le 1 = %v", out)
+	}
+
+	out, _ = numberEncodings["u32be"].encode("u32be", 4294967295)
+	if !reflect.DeepEqual(out, []byte{0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("u32be 4294967295 = %v", out)
+	}
+	out, _ = numberEncodings["f32le"].encode("f32le", 0.1)
+	if got, _ := decodeInput("f32le", out); got[0] != float64(float32(0.1)) {
+		t.Errorf("f32le round trip of 0.1 = %v", got[0])
+	}
+
+	//f64 keeps every value
+	for _, val := range []float64{0.1, 1e300, math.Inf(-1)} {
+		out, _ := numberEncodings["f64be"].encode("f64be", val)
+		got, _ := decodeInput("f64be", out)
+		if got[0] != val {
+			t.Errorf("f64be round trip of %v = %v", val, got[0])
+		}
+	}
+
+	//Integers must fit
+	for _, test := range []struct {
+		name string
+		val  float64
+	}{{"i16le", 32768}, {"i16le", -32769}, {"i32be", 2.5}, {"i32le", 1 << 31}, {"i32le", math.NaN()}, {"u16le", -1}, {"u16be", 65536}, {"u32le", 1 << 32}} {
+		if _, err := numberEncodings[test.name].encode(test.name, test.val); err == nil {
+			t.Errorf("%s: encode(%v) should fail", test.name, test.val)
+		}
+	}
+
+	//Input must be made of whole values
+	if _, err := decodeInput("i32le", []byte{1, 2, 3}); err == nil {
+		t.Errorf("decoding 3 bytes as i32le should fail")
+	}
+}
+
+func TestUTF8Input(t *testing.T) {
+	got, err := decodeInput(inputUTF8, []byte("aé😀\xff!"))
+	want := []float64{'a', 'é', '😀', 0xfffd, '!'}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("utf8 input = %v, %v, want %v", got, err, want)
+	}
+}
+
+func TestBinaryOutput(t *testing.T) {
+	file, err := os.CreateTemp(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldFile, oldToFile, oldConsole, oldFormat := outputFile, writeToFile, consoleOutput, outputFormat
+	defer func() {
+		outputFile, writeToFile, consoleOutput, outputFormat = oldFile, oldToFile, oldConsole, oldFormat
+	}()
+	outputFile, writeToFile, consoleOutput, outputFormat = file, true, false, "i16le"
+
+	//Both ! and # write the value itself
+	printValue(token.PrintNumber, 1000)
+	printValue(token.PrintChar, -1)
+	if err := printValue(token.PrintNumber, 0.5); err == nil {
+		t.Errorf("writing 0.5 as i16le should fail")
+	}
+	file.Close()
+
+	raw, _ := os.ReadFile(file.Name())
+	if !reflect.DeepEqual(raw, []byte{0xe8, 0x03, 0xff, 0xff}) {
+		t.Errorf("output = %v", raw)
+	}
+}
+
+func TestTextInput(t *testing.T) {
+	got, err := textInput([]byte(" 1 -2\t3.5\n,5 "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []float64{1, -2, 3.5, 0.5}
+	if len(got) != len(want) {
+		t.Fatalf("textInput = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("textInput = %v, want %v", got, want)
+		}
+	}
+
+	//Invalid entries
+	for _, bad := range []string{"1..2", "5-", "abc"} {
+		if _, err := textInput([]byte(bad)); err == nil {
+			t.Errorf("textInput(%q) should fail", bad)
+		}
+	}
+
+	//Errors name the entry
+	_, err = textInput([]byte("1 2\n0x1G"))
+	if err == nil || err.Error() != "entry 3 '0x1G': 'G' is not a base 16 digit" {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestNextInstruction(t *testing.T) {
+	src := "1 = <\n0+1+2 ?= 3 [\n1++\n]\n>\n5 += 1\n1()"
+	prog, diagnostics := parser.Parse([]byte(src))
+	if len(diagnostics) != 0 {
+		t.Fatalf("program did not parse: %v", diagnostics)
+	}
+	code := prog.Code
+
+	//Walk the program, must end exactly at its end
+	pos := 0
+	count := 0
+	for pos < len(code) {
+		pos = nextInstruction(code, pos)
+		count++
+	}
+	if pos != len(code) || count != 8 {
+		t.Errorf("walked %d instructions to %d, want 8 to %d", count, pos, len(code))
+	}
+}
+
+func TestCommandFlags(t *testing.T) {
+	name, limit, on := "", 0, false
+	cmd := &command{
+		name: "example",
+		flags: []*flagDef{
+			{name: "name", short: "n", value: "<name>", set: setString(&name)},
+			{name: "limit", value: "<n>", set: setLimit(&limit)},
+			{name: "on", short: "o", set: setTrue(&on)},
+		},
+	}
+
+	//Every way to write a flag, mixed with arguments
+	rest, err := cmd.parse([]string{"a", "-n", "x", "--limit=5", "-", "-o", "--", "-n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rest, []string{"a", "-", "-n"}) || name != "x" || limit != 5 || !on {
+		t.Errorf("rest = %q, name %q, limit %d, on %v", rest, name, limit, on)
+	}
+	if _, err := cmd.parse([]string{"-n=y", "--name", "z"}); err != nil || name != "z" {
+		t.Errorf("name = %q, error %v", name, err)
+	}
+
+	//Mistakes
+	for args, want := range map[string]string{
+		"--what":     "unknown flag '--what'",
+		"-x=1":       "unknown flag '-x'",
+		"--name":     "flag --name needs a name",
+		"--on=yes":   "flag --on doesn't take a value",
+		"--limit=-1": "--limit: invalid number '-1'",
+	} {
+		if _, err := cmd.parse(strings.Fields(args)); err == nil || err.Error() != want {
+			t.Errorf("parse(%s) error = %v, want %s", args, err, want)
+		}
+	}
+}
+
+func TestCommandHelp(t *testing.T) {
+	var out strings.Builder
+	testCommand().printHelp(&out)
+	want := "Usage: numskull test [flags] [path...]\n"
+	if !strings.HasPrefix(out.String(), want) {
+		t.Errorf("help starts with %q", strings.SplitN(out.String(), "\n", 2)[0])
+	}
+	if !strings.Contains(out.String(), "\t--update       Write the actual output") || !strings.Contains(out.String(), "\t-v, --verbose  Also list tests that passed") {
+		t.Errorf("flags are not listed:\n%s", out.String())
+	}
+
+	//Every flag of every command can be explained
+	for _, cmd := range allCommands() {
+		for _, flag := range cmd.flags {
+			if flag.usage == "" || cmd.lookup(flag.name) != flag {
+				t.Errorf("numskull %s --%s has no usage", cmd.name, flag.name)
+			}
+		}
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, src string) string {
+		path := dir + "/" + name
+		if err := os.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	good := write("good.nms", "65#")
+	broken := write("broken.nms", "1 ?? 2")
+	failing := write("failing.nms", "5 = 1\n5()")
+	endless := write("endless.nms", "1 ?= 1 [\n]")
+
+	var stdout, stderr strings.Builder
+	oldWriter, oldErrors, oldSteps := consoleWriter, errorOutput, maxSteps
+	oldProfiling, oldCovering := profiling, covering
+	defer func() {
+		consoleWriter, errorOutput, maxSteps = oldWriter, oldErrors, oldSteps
+		profiling, covering = oldProfiling, oldCovering
+	}()
+	consoleWriter, errorOutput = &stdout, &stderr
+
+	tests := []struct {
+		args   []string
+		status int
+		stdout string
+		stderr string
+	}{
+		{[]string{"run", good}, exitOK, "A", ""},
+		{[]string{good}, exitOK, "A", ""},
+		{[]string{"run", broken}, exitParse, "", "Line 1, column 3: Unknown operation '??'"},
+		{[]string{"check", broken}, exitParse, "", broken + ": Line 1, column 3"},
+		{[]string{"run", failing}, exitError, "", "invalid function call"},
+		{[]string{"run", "--max-steps=100", endless}, exitLimit, "", "step limit exceeded"},
+		{[]string{"run", "--what", good}, exitUsage, "", "unknown flag '--what'"},
+		{[]string{"run", dir + "/missing.nms"}, exitError, "", "Error opening program file"},
+		{[]string{"run", "-q", failing}, exitError, "", ""},
+		{[]string{"run", "--profile", dir + "/missing/profile.txt", good}, exitError, "A", "Error writing profile"},
+		{[]string{"run", "--cover", dir + "/missing/cover.out", good}, exitError, "A", "Error writing coverage"},
+	}
+	for _, test := range tests {
+		stdout.Reset()
+		stderr.Reset()
+		resetRuntime()
+		maxSteps = oldSteps
+		profiling, covering = oldProfiling, oldCovering
+		errorOutput = &stderr
+		status := runCLI(test.args)
+		if status != test.status || stdout.String() != test.stdout || !strings.Contains(stderr.String(), test.stderr) || (test.stderr == "" && stderr.Len() != 0) {
+			t.Errorf("numskull %s: status %d, stdout %q, stderr %q", strings.Join(test.args, " "), status, stdout.String(), stderr.String())
+		}
+	}
+}
+
+func TestProgramSources(t *testing.T) {
+	var stdout, stderr strings.Builder
+	oldWriter, oldErrors, oldStdin, oldConsole := consoleWriter, errorOutput, stdin, consoleInput
+	defer func() {
+		consoleWriter, errorOutput, stdin, consoleInput = oldWriter, oldErrors, oldStdin, oldConsole
+	}()
+	consoleWriter, errorOutput = &stdout, &stderr
+
+	run := func(stdinText string, args ...string) int {
+		stdout.Reset()
+		stderr.Reset()
+		resetRuntime()
+		consoleInput = true
+		stdin = bufio.NewReader(strings.NewReader(stdinText))
+		return runCLI(args)
+	}
+
+	//Inline code, every -e is a line, input still comes from the console
+	if status := run("5", "-e", "1\"", "-e", "1 += 60", "-e", "1#"); status != exitOK || stdout.String() != "A" {
+		t.Errorf("-e: status %d, stdout %q, stderr %q", status, stdout.String(), stderr.String())
+	}
+	if status := run("", "run", "-e", "1!", "program.nms"); status != exitUsage {
+		t.Errorf("-e with a program file: status %d", status)
+	}
+
+	//Program from stdin
+	if status := run("66#\n"); status != exitUsage {
+		t.Errorf("no arguments: status %d", status)
+	}
+	if status := run("66#\n", "run", "-"); status != exitOK || stdout.String() != "B" {
+		t.Errorf("run -: status %d, stdout %q, stderr %q", status, stdout.String(), stderr.String())
+	}
+
+	//Stdin can't hold input as well
+	status := run("1\"\n1!\n", "run", "-")
+	if status != exitError || !strings.Contains(stderr.String(), "use -i to read input from a file, at line 1") {
+		t.Errorf("reading input: status %d, stderr %q", status, stderr.String())
+	}
+}
+
+func TestBytecode(t *testing.T) {
+	prog, diagnostics := parser.Parse([]byte("1 = <\n0+1+2 ?= 3 [\n1++\n]\n>\n5 += 1.5 - 2\n1 ?= 0+5 {\n}\n1()"))
+	if len(diagnostics) != 0 {
+		t.Fatalf("program did not parse: %v", diagnostics)
+	}
+
+	//Round trip
+	var raw strings.Builder
+	if err := writeBytecode(&raw, prog.Code, prog.Lines); err != nil {
+		t.Fatal(err)
+	}
+	if !isBytecode([]byte(raw.String())) {
+		t.Errorf("bytecode isn't recognized")
+	}
+	code, lines, err := readBytecode([]byte(raw.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(code, prog.Code) || !reflect.DeepEqual(lines, prog.Lines) {
+		t.Errorf("read %v, lines %v", code, lines)
+	}
+
+	//Broken files
+	file := []byte(raw.String())
+	for name, broken := range map[string][]byte{
+		"truncated":   file[:len(file)-1],
+		"version":     append([]byte("NSKB\x02"), file[5:]...),
+		"instruction": append(append([]byte{}, file[:12]...), append([]byte{0, 0, 0, 0, 0, 0, 0x59, 0x40}, file[20:]...)...),
+	} {
+		if _, _, err := readBytecode(broken); err == nil {
+			t.Errorf("reading %s bytecode should fail", name)
+		}
+	}
+
+	//Jumping into the middle of an instruction
+	raw.Reset()
+	crafted := []float64{float64(token.SquareEnd), 5, float64(token.Number), 1, float64(token.Assign), float64(token.Number), 5}
+	if err := writeBytecode(&raw, crafted, make([]int, len(crafted))); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readBytecode([]byte(raw.String())); err == nil || !strings.Contains(err.Error(), "isn't the start of an instruction") {
+		t.Errorf("reading bytecode with a jump into an instruction: error %v", err)
+	}
+	path := t.TempDir() + "/crafted.nsb"
+	if err := os.WriteFile(path, []byte(raw.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var stderr strings.Builder
+	oldErrors := errorOutput
+	defer func() { errorOutput = oldErrors }()
+	errorOutput = &stderr
+	resetRuntime()
+	if status := runCLI([]string{"run", path}); status == exitOK || !strings.Contains(stderr.String(), "isn't the start of an instruction") {
+		t.Errorf("running crafted bytecode: status %d, stderr %q", status, stderr.String())
+	}
+
+	//Unknown instructions are reported, not skipped
+	resetRuntime()
+	if err := runProgram([]float64{float64(token.Newline)}); err == nil || !strings.Contains(err.Error(), "unknown instruction") {
+		t.Errorf("running an unknown instruction: error %v", err)
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	prog, _ := parser.Parse([]byte("1 = <\n0+1 - 2 ?= 3 [\n1!\n]\n>\n1()"))
+	oldLines := programLines
+	defer func() { programLines = oldLines }()
+	programLines = prog.Lines
+
+	var out strings.Builder
+	disassemble(&out, prog.Code)
+	want := "" +
+		"     0  line 1    1 = 5\n" +
+		"     5  line 1    < jump 25\n" +
+		"     7  line 2    0+1 - 2 ?= 3 jump 24\n" +
+		"    19  line 3    1!\n" +
+		"    22  line 4    ] jump 7\n" +
+		"    24  line 5    >\n" +
+		"    25  line 6    1()\n"
+	if out.String() != want {
+		t.Errorf("disassemble =\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestREPL(t *testing.T) {
+	var out, errs strings.Builder
+	oldStdin, oldWriter, oldErrors := stdin, consoleWriter, errorOutput
+	defer func() { stdin, consoleWriter, errorOutput = oldStdin, oldWriter, oldErrors }()
+	consoleWriter, errorOutput = &out, &errs
+	stdin = bufio.NewReader(strings.NewReader("1 = 5\n2 = <\n1!\n>\n2()\n1 ?? 2\n:reset\n1!\n3 = 5\n3()\n"))
+
+	runREPL(stdin, &out)
+	want := "Numskull " + version_language + " - type :quit to leave\n" +
+		"> > ... ... > 5\n" +
+		"> > > 1\n> > > \n"
+	if out.String() != want {
+		t.Errorf("output = %q, want %q", out.String(), want)
+	}
+
+	//Errors go to errorOutput, not with the program output
+	wantErrs := "Line 6, column 3: Unknown operation '??'\n\t1 ?? 2\n\t  ^\n" +
+		"error: invalid function call\n"
+	if errs.String() != wantErrs {
+		t.Errorf("errors = %q, want %q", errs.String(), wantErrs)
+	}
+}
+
+func FuzzRun(f *testing.F) {
+	for _, seed := range []string{
+		"5!",
+		"1 = 10\n1 ?> 5 [\n1!\n1--\n]\n",
+		"1 = <\n1()\n>\n1()",
+		"0 /= 0\n0()",
+		"5 = 25\n7 = 4\n7()",
+		"1 = <\n>\n1 -= 1\n1()",
+		"1\"\n0+1()",
+		"1 ?= 1 [\n1 ?! 4 {\n]\n}\n",
+	} {
+		f.Add(seed, "1 2 3")
+	}
+
+	oldSteps, oldDepth, oldTrace, oldErrors := maxSteps, maxCallDepth, traceOutput, errorOutput
+	f.Cleanup(func() { maxSteps, maxCallDepth, traceOutput, errorOutput = oldSteps, oldDepth, oldTrace, oldErrors })
+	maxSteps, maxCallDepth = 10000, 100
+	traceOutput, errorOutput = io.Discard, io.Discard
+
+	f.Fuzz(func(t *testing.T, src string, in string) {
+		if len(src) > 4096 || len(in) > 4096 {
+			return
+		}
+		runTestProgram("fuzz.nms", []byte(src), []byte(in), true)
+	})
+}
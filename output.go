@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"numskull/token"
+)
+
+//Character output modes for "#"
+const (
+	charUnicode string = "unicode"
+	charByte    string = "byte"
+)
+
+//What "#" does with values that aren't characters
+const (
+	invalidCharError   string = "error"
+	invalidCharReplace string = "replace"
+)
+
+//Is this a known character mode?
+func validCharMode(mode string) bool {
+	return mode == charUnicode || mode == charByte
+}
+
+//Is this a known way to handle invalid characters?
+func validInvalidChar(action string) bool {
+	return action == invalidCharError || action == invalidCharReplace
+}
+
+//Encode a value printed with "#".
+//Unicode mode writes the UTF-8 encoding of the code point.
+//Byte mode writes a single byte, wrapping whole numbers outside 0-255 like older versions did.
+func encodeChar(val float64) ([]byte, error) {
+
+	//Must be a whole number
+	valid := !math.IsNaN(val) && !math.IsInf(val, 0) && val == math.Trunc(val)
+	if valid && charMode == charByte {
+		return []byte{byte(int64(math.Mod(val, 256)))}, nil
+	}
+
+	//Must be a valid code point, surrogates are not characters
+	if valid && val >= 0 && val <= utf8.MaxRune && utf8.ValidRune(rune(val)) {
+		return []byte(string(rune(val))), nil
+	}
+
+	//Invalid value
+	if invalidChar == invalidCharReplace {
+		if charMode == charByte {
+			return []byte{'?'}, nil
+		}
+		return []byte(string(utf8.RuneError)), nil
+	}
+	return nil, fmt.Errorf("can't print %s as a character", formatTraceNumber(val))
+}
+
+//Number formats for "!"
+const (
+	numberShortest   string = "shortest"
+	numberFixed      string = "fixed"
+	numberInteger    string = "integer"
+	numberScientific string = "scientific"
+)
+
+//Decimals used by the fixed format when none are given
+const defaultFixedDecimals int = 6
+
+//Read a number format like "fixed:3", returns the format and its number of decimals.
+//Decimals are -1 when the format picks them itself.
+func parseNumberFormat(text string) (string, int, error) {
+	format, decimalText, hasDecimals := strings.Cut(strings.ToLower(text), ":")
+	switch format {
+	case numberShortest, numberInteger:
+		if hasDecimals {
+			return "", 0, fmt.Errorf("the %s format has no decimals", format)
+		}
+		return format, -1, nil
+	case numberFixed, numberScientific:
+	default:
+		return "", 0, fmt.Errorf("unknown number format '%s'", text)
+	}
+
+	//Read decimals
+	if !hasDecimals {
+		if format == numberFixed {
+			return format, defaultFixedDecimals, nil
+		}
+		return format, -1, nil
+	}
+	decimals, err := strconv.Atoi(decimalText)
+	if err != nil || decimals < 0 || decimals > 100 {
+		return "", 0, fmt.Errorf("invalid number of decimals '%s'", decimalText)
+	}
+	return format, decimals, nil
+}
+
+//Format a value printed with "!"
+func formatOutputNumber(val float64) (string, error) {
+
+	//Same in every format, except integer
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		if numberFormat == numberInteger {
+			return "", fmt.Errorf("can't print %s as an integer", formatTraceNumber(val))
+		}
+		if math.IsNaN(val) {
+			return "NaN", nil
+		} else if val < 0 {
+			return "-Inf", nil
+		}
+		return "Inf", nil
+	}
+
+	switch numberFormat {
+	case numberFixed:
+		return strconv.FormatFloat(val, 'f', numberDecimals, 64), nil
+	case numberScientific:
+		return strconv.FormatFloat(val, 'e', numberDecimals, 64), nil
+	case numberInteger:
+		if val != math.Trunc(val) {
+			return "", fmt.Errorf("can't print %s as an integer", formatTraceNumber(val))
+		}
+		return strconv.FormatFloat(val, 'f', 0, 64), nil
+	}
+
+	//Shortest representation that reads back as the same number, never in exponent notation
+	return strconv.FormatFloat(val, 'f', -1, 64), nil
+}
+
+//Write a value printed with "#" or "!" to the console and output file.
+//Binary output formats write the value itself to the file, no matter the operation.
+func printValue(tok token.Token, val float64) error {
+
+	//Text, only when needed
+	var text []byte
+	if consoleOutput || (writeToFile && outputFormat == outputText) {
+		if tok == token.PrintChar {
+			out, err := encodeChar(val)
+			if err != nil {
+				return err
+			}
+			text = out
+		} else {
+			out, err := formatOutputNumber(val)
+			if err != nil {
+				return err
+			}
+			text = []byte(out)
+		}
+	}
+
+	//Output it
+	if consoleOutput {
+		consoleWriter.Write(text)
+	}
+	if writeToFile {
+		if outputFormat != outputText {
+			raw, err := numberEncodings[outputFormat].encode(outputFormat, val)
+			if err != nil {
+				return err
+			}
+			outputFile.Write(raw)
+		} else {
+			outputFile.Write(text)
+		}
+	}
+	return nil
+}
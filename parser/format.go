@@ -0,0 +1,185 @@
+package parser
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+//Spaces per level of brackets
+const formatIndent string = "    "
+
+//One line of source code, split up for formatting
+type formatLine struct {
+	indent  string
+	words   []string
+	comment string
+	column  int
+	keep    bool
+}
+
+//Format a program the same way every time.
+//Lines are indented by 4 spaces per open bracket, and operations are spaced out like the examples.
+//Comments after code keep their column, moved along with the indent.
+//Lines with block comments are kept as is, apart from trailing whitespace.
+//Programs with errors aren't formatted, the diagnostics are returned instead.
+func Format(src []byte) ([]byte, []Diagnostic) {
+	if _, diagnostics := Parse(src); len(diagnostics) != 0 {
+		return nil, diagnostics
+	}
+
+	//Format line by line
+	var out strings.Builder
+	depth := 0
+	for _, line := range splitFormatLines(string(src)) {
+		if len(line.words) != 0 && isClosingWord(line.words[0]) && depth > 0 {
+			depth--
+		}
+		out.WriteString(line.format(strings.Repeat(formatIndent, depth)))
+		out.WriteByte('\n')
+		if len(line.words) != 0 && isOpeningWord(line.words[len(line.words)-1]) {
+			depth++
+		}
+	}
+
+	//Exactly one newline at the end
+	return []byte(strings.TrimRight(out.String(), "\n") + "\n"), nil
+}
+
+//How many brackets are still open at the end of a program.
+//The REPL uses this to know when a line needs more input.
+func OpenBrackets(src []byte) int {
+	depth := 0
+	for _, line := range splitFormatLines(string(src)) {
+		for _, word := range line.words {
+			if isOpeningWord(word) {
+				depth++
+			} else if isClosingWord(word) {
+				depth--
+			}
+		}
+	}
+	return depth
+}
+
+//Split source code into lines of words and comments
+func splitFormatLines(src string) []formatLine {
+	rawLines := strings.Split(strings.ReplaceAll(src, "\r", ""), "\n")
+	lines := make([]formatLine, 0, len(rawLines))
+	inBlock := false
+	for _, raw := range rawLines {
+		line := formatLine{keep: inBlock, column: -1}
+
+		//Find comments, blanking block comments out of the code
+		code := []byte(raw)
+		for pos := 0; pos < len(code); pos++ {
+			switch {
+			case inBlock:
+				if code[pos] == '*' && pos+1 < len(code) && code[pos+1] == '/' {
+					inBlock = false
+					code[pos+1] = ' '
+				}
+				code[pos] = ' '
+			case code[pos] == '/' && pos+1 < len(code) && code[pos+1] == '*':
+				inBlock = true
+				line.keep = true
+				code[pos] = ' '
+			case code[pos] == '/' && pos+1 < len(code) && code[pos+1] == '/':
+				line.comment = raw[pos:]
+				line.column = utf8.RuneCountInString(raw[:pos])
+				code = code[:pos]
+			}
+		}
+
+		//Split the code into words
+		text := string(code)
+		trimmed := strings.TrimLeft(text, " \t")
+		line.indent = text[:len(text)-len(trimmed)]
+		if line.keep {
+			line.comment = strings.TrimRight(raw, " \t")
+		}
+		pos := 0
+		for {
+			word, done := readWord(text, &pos)
+			if done {
+				break
+			}
+			line.words = append(line.words, word)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+//Write the line with the given indent
+func (line formatLine) format(indent string) string {
+
+	//Block comments are kept as is
+	if line.keep {
+		return line.comment
+	}
+
+	//Join the words
+	code := ""
+	for i, word := range line.words {
+		if i != 0 {
+			code += wordSeparator(line.words, i)
+		}
+		code += word
+	}
+	if code == "" {
+		if line.comment == "" {
+			return ""
+		}
+		return indent + line.comment
+	}
+	code = indent + code
+	if line.comment == "" {
+		return code
+	}
+
+	//Keep the comment where it was, moved along with the indent
+	column := line.column + utf8.RuneCountInString(indent) - utf8.RuneCountInString(line.indent)
+	gap := column - utf8.RuneCountInString(code)
+	if gap < 1 {
+		gap = 1
+	}
+	return code + strings.Repeat(" ", gap) + line.comment
+}
+
+//What goes before the word at index i
+func wordSeparator(words []string, i int) string {
+	word := words[i]
+	switch {
+
+	//Operations on the number before it, like 1++ or 5#
+	case word == "++" || word == "--" || word == "!" || word == "#" || word == "\"" || word == "()":
+		return ""
+	case word == "_" || word == "^" || word == "~" || word == "||" || word == "+-" || word == "_/":
+		return ""
+
+	//Chaining is tight like 0+1+3, but a minus must stay its own word, like 0 - 1 or 0 + -1
+	case word == "-" || words[i-1] == "-":
+		return " "
+	case word == "+":
+		if i+1 < len(words) && strings.HasPrefix(words[i+1], "-") {
+			return " "
+		}
+		return ""
+	case words[i-1] == "+":
+		if strings.HasPrefix(word, "-") {
+			return " "
+		}
+		return ""
+	}
+	return " "
+}
+
+//Opens a bracket, at the end of a line
+func isOpeningWord(word string) bool {
+	return word == "{" || word == "[" || word == "<"
+}
+
+//Closes a bracket, alone on a line
+func isClosingWord(word string) bool {
+	return word == "}" || word == "]" || word == ">"
+}
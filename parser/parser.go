@@ -5,33 +5,116 @@ import (
 	"fmt"
 	"numskull/token"
 	"numskull/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
+//Comments starting with this are kept as directives
+const TestDirectivePrefix string = "test:"
+
+//A "//test:" comment found in a program
+type Directive struct {
+	Line int
+	Text string
+}
+
+//An error at a known place in the program.
+//Column is zero when only the line is known.
+type Diagnostic struct {
+	Line    int
+	Column  int
+	Word    string
+	Message string
+	Source  string
+}
+
+//Message, followed by the source line with a caret under the column
+func (d Diagnostic) Error() string {
+	if d.Column == 0 {
+		return fmt.Sprintf("Line %d: %s", d.Line, d.Message)
+	}
+	out := fmt.Sprintf("Line %d, column %d: %s", d.Line, d.Column, d.Message)
+	if d.Source == "" {
+		return out
+	}
+
+	//Keep tabs, so the caret lines up
+	indent := ""
+	column := 1
+	for _, char := range d.Source {
+		if column == d.Column {
+			break
+		}
+		indent += blank(char)
+		column++
+	}
+	return out + "\n\t" + strings.TrimRight(d.Source, " \t") + "\n\t" + indent + "^"
+}
+
 type programContext struct {
 	jumplinepos         int
 	jumplinedestination int
 	startedLine         int
+	isElse              bool
+	functions           int
+	breaks              []int
 }
 
-//Preprocess program
-func ParseProgram(raw string) ([]float64, bool) {
+//A parsed program
+type Program struct {
+	Code       []float64
+	Lines      []int
+	Directives []Directive
+}
 
-	//Different channels I need
-	lines := make(chan string)
-	tokens := make(chan []float64)
-	errors := make(chan error)
+//Parse a program, one line at a time without any goroutines.
+//Diagnostics are in source order, and the program can only be run if there are none.
+//Lines holds the source line of every position in Code.
+func Parse(src []byte) (*Program, []Diagnostic) {
+	prog := &Program{Directives: make([]Directive, 0, 4)}
+	diagnostics := make([]Diagnostic, 0)
+	v := newValidator(func(d Diagnostic) {
+		diagnostics = append(diagnostics, d)
+	})
+
+	//Every stage handles a line before the next one is read
+	linecount := 0
+	separateLines(string(src), func(line string) {
+		linecount++
+		toks, errs := tokenizeLine(line, linecount)
+		diagnostics = append(diagnostics, errs...)
+		v.addLine(toks)
+	}, &prog.Directives)
+	v.finish()
+
+	//Unclosed brackets are only found at the end, but belong to the line they were opened on
+	sort.SliceStable(diagnostics, func(i, j int) bool {
+		if diagnostics[i].Line != diagnostics[j].Line {
+			return diagnostics[i].Line < diagnostics[j].Line
+		}
+		return diagnostics[i].Column < diagnostics[j].Column
+	})
+
+	prog.Code, prog.Lines = v.program, v.lines
+	return prog, diagnostics
+}
 
-	//Actually preprocess program
-	go logErrors(errors)
-	go programSeperate(*bytes.NewBufferString(raw), lines, errors)
-	go TokenizeLines(lines, tokens, errors)
-	return validateTokens(tokens, errors)
+//Find every "//test:" directive in a program, used by the test runner
+func TestDirectives(raw string) []Directive {
+	directives := make([]Directive, 0, 4)
+	separateLines(raw, func(string) {}, &directives)
+	return directives
 }
 
-//Seperate program per line
-func programSeperate(program bytes.Buffer, lines chan<- string, errors chan<- error) {
+//Seperate program per line, emitting every line.
+//If directives isn't nil, "//test:" comments are saved to it.
+func separateLines(raw string, emit func(string), directives *[]Directive) {
+	program := bytes.NewBufferString(raw)
 
 	currentLine := ""
+	linecount := 0
 	var prevChar rune = 0
 
 	//thing
@@ -55,22 +138,34 @@ func programSeperate(program bytes.Buffer, lines chan<- string, errors chan<- er
 				currentLine = currentLine[:len(currentLine)-1]
 
 				//Skip to next newline
+				comment := ""
 				for char != '\n' && err == nil {
 					char, _, err = program.ReadRune()
+					if err == nil && char != '\n' && char != '\r' {
+						comment += string(char)
+					}
 				}
 
 				//No character was found
 				if err != nil {
 					char = 0
 				}
+
+				//Keep directives
+				if directives != nil && strings.HasPrefix(comment, TestDirectivePrefix) {
+					*directives = append(*directives, Directive{
+						Line: linecount + 1,
+						Text: strings.TrimSpace(strings.TrimPrefix(comment, TestDirectivePrefix)),
+					})
+				}
 			}
 
 			//Multiline comment?
 			if char == '*' && prevChar == '/' {
 
-				//Place a space
+				//Blank it out, so columns stay the same
 				currentLine = currentLine[:len(currentLine)-1]
-				currentLine += " "
+				currentLine += "  "
 
 				//Wait for comment closure
 				prevChar = 0
@@ -79,13 +174,17 @@ func programSeperate(program bytes.Buffer, lines chan<- string, errors chan<- er
 
 					//End of comment?
 					if prevChar == '*' && char == '/' {
+						currentLine += " "
 						break
 					}
 
 					//Newline?
 					if char == '\n' {
-						lines <- currentLine
+						emit(currentLine)
+						linecount++
 						currentLine = ""
+					} else if err == nil {
+						currentLine += blank(char)
 					}
 
 					prevChar = char
@@ -94,8 +193,9 @@ func programSeperate(program bytes.Buffer, lines chan<- string, errors chan<- er
 				continue
 			}
 
-			//Push line into output channel
-			lines <- currentLine
+			//Emit line
+			emit(currentLine)
+			linecount++
 
 			//Reset variables and continue loop
 			currentLine = ""
@@ -110,320 +210,450 @@ func programSeperate(program bytes.Buffer, lines chan<- string, errors chan<- er
 
 	//Add last line
 	if len(currentLine) != 0 {
-		lines <- currentLine
+		emit(currentLine)
 	}
-
-	//Close channel
-	close(lines)
 }
 
-//Handle lines
-func TokenizeLines(lines <-chan string, tokens chan<- []float64, errors chan<- error) {
+//Whitespace that takes the place of a character in a comment
+func blank(char rune) string {
+	if char == '\t' {
+		return "\t"
+	}
+	return " "
+}
 
-	//Repeat for as long as there are lines
-	linecount := 0
-	for msg := range lines {
-		linecount++
-		pos := 0
-		line := make([]float64, 0, 32)
-		for {
+//Turn one line into tokens.
+//Lines with unknown words become a single Invalid token.
+func tokenizeLine(msg string, linecount int) ([]float64, []Diagnostic) {
+	pos := 0
+	line := make([]float64, 0, 32)
+	var errs []Diagnostic
+	for {
 
-			//Read Token
-			tok, num, err := readToken(msg, &pos, linecount)
-			if err != nil {
-				fmt.Println(err)
-			}
+		//Read Token, and keep going to find every error on the line
+		tok, num, err := readToken(msg, &pos, linecount)
+		if err != nil {
+			errs = append(errs, *err)
+			continue
+		}
 
-			//Add Token to slice
-			line = append(line, float64(tok))
+		//Add Token to slice
+		line = append(line, float64(tok))
 
-			//Newline, end of current line
-			if tok == token.Newline {
-				break
-			}
+		//Newline, end of current line
+		if tok == token.Newline {
+			break
+		}
 
-			//Was this a number?
-			if tok == token.Number {
-				line = append(line, num)
-			}
+		//Was this a number?
+		if tok == token.Number {
+			line = append(line, num)
 		}
+	}
 
-		//Send this slice through channel
-		tokens <- line
+	if len(errs) != 0 {
+		return []float64{float64(token.Invalid)}, errs
 	}
+	return line, nil
+}
 
-	//Alright, we done
-	close(tokens)
+//Builds the finished program, one line of tokens at a time
+type validator struct {
+	program   []float64
+	lines     []int
+	curlies   []programContext
+	squares   []programContext
+	anglies   []programContext
+	success   bool
+	broken    bool
+	linecount int
+	lineStart int
+	report    func(Diagnostic)
 }
 
-//Make sure this stuff is valid code, and construct finished program
-func validateTokens(tokens <-chan []float64, errors chan<- error) ([]float64, bool) {
+//Create a validator, errors are passed to report
+func newValidator(report func(Diagnostic)) *validator {
+	return &validator{
+		program:   make([]float64, 0, 1024),
+		lines:     make([]int, 0, 1024),
+		curlies:   make([]programContext, 0, 64),
+		squares:   make([]programContext, 0, 64),
+		anglies:   make([]programContext, 0, 64),
+		success:   true,
+		lineStart: -1,
+		report:    report,
+	}
+}
 
-	//Finished program
-	program := make([]float64, 0, 1024)
-	curlies := make([]programContext, 0, 64)
-	squares := make([]programContext, 0, 64)
-	anglies := make([]programContext, 0, 64)
+//Easier error logging
+func (v *validator) e(format string, args ...interface{}) {
+	v.report(Diagnostic{Line: v.linecount, Message: fmt.Sprintf(format, args...)})
+	v.success = false
+}
 
-	success := true
-	linecount := 0
-	lineStart := -1
+//Validate the next line
+func (v *validator) addLine(toks []float64) {
 
-	//Easier error logging
-	e := func(s string) {
-		errors <- fmt.Errorf(s)
-		success = false
+	//Everything written by the previous line belongs to it
+	for len(v.lines) < len(v.program) {
+		v.lines = append(v.lines, v.linecount)
 	}
+	v.linecount++
 
-	for toks := range tokens {
-		linecount++
+	//Read tokens one by one, a missing token is the end of the line
+	pos := 0
+	next := func() token.Token {
+		if pos >= len(toks) {
+			return token.Newline
+		}
+		tok := token.Token(toks[pos])
+		pos++
+		return tok
+	}
 
-		//Is there anything on this line
-		if len(toks) == 0 || toks[0] == float64(token.Newline) {
-			continue
+	//Read the value of a number token
+	value := func() (float64, bool) {
+		if pos >= len(toks) {
+			return 0, false
 		}
+		pos++
+		return toks[pos-1], true
+	}
 
-		//Expecting start bracket?
-		tok := token.Token(toks[0])
+	//Expect a number, with a precise message if it's not there
+	expectNumber := func(after string) (float64, bool) {
+		tok := next()
+		if tok != token.Number {
+			v.e("Expected number after '%s', found %s", after, describeToken(tok))
+			return 0, false
+		}
+		num, ok := value()
+		if !ok {
+			v.e("Expected number after '%s', found end of line", after)
+		}
+		return num, ok
+	}
 
-		//Is this an end bracket?
-		if tok == token.CurlyEnd || tok == token.SquareEnd || tok == token.FunctionEnd {
-			next := token.Token(toks[1])
+	//Expect the line to end
+	expectNewline := func(after string) bool {
+		tok := next()
+		if tok != token.Newline {
+			v.e("Expected newline after '%s', found %s", after, describeToken(tok))
+			return false
+		}
+		return true
+	}
 
-			//Expect newline
-			if len(toks) > 2 || next != token.Newline {
-				e(fmt.Sprintf("Line %d: Expected newline, got '%s'", linecount, next.GetTokenName()))
-				continue
-			}
+	//Is there anything on this line
+	tok := next()
+	if tok == token.Newline {
+		return
+	}
 
-			//Get relevant stack
-			cnts := &squares
-			if tok == token.CurlyEnd {
-				cnts = &curlies
-			} else if tok == token.FunctionEnd {
-				cnts = &anglies
-			}
+	//Already reported by the tokenizer.
+	//Brackets on this line are lost, so bracket errors would be misleading from now on.
+	if tok == token.Invalid && len(toks) == 1 {
+		v.broken = true
+		return
+	}
 
-			//Check if stack is empty
-			if len(*cnts) == 0 {
-				e(fmt.Sprintf("Line %d: Unmatched '%s'", linecount, tok.GetTokenName()))
-				continue
-			}
+	//Is this an end bracket?
+	if tok == token.CurlyEnd || tok == token.SquareEnd || tok == token.FunctionEnd {
 
-			//Pop context off stack
-			cnt := []programContext(*cnts)[len(*cnts)-1]
-			*cnts = []programContext(*cnts)[:len(*cnts)-1]
+		//Is this an else branch, "} {"?
+		name := tok.GetTokenName()
+		isElse := tok == token.CurlyEnd && pos < len(toks) && token.Token(toks[pos]) == token.CurlyStart
+		if isElse {
+			pos++
+			name = token.Else.GetTokenName()
+		}
 
-			//Was it a looping bracket?
-			if tok == token.SquareEnd {
-				program = append(program, float64(token.SquareEnd), float64(cnt.jumplinepos))
-			} else if tok == token.FunctionEnd {
-				program = append(program, float64(token.FunctionEnd))
-			}
-			program[cnt.jumplinedestination] = float64(len(program))
-			continue
+		//Expect newline
+		if !expectNewline(name) {
+			return
 		}
 
-		//Then this should be a number
-		if tok != token.Number {
-			e(fmt.Sprintf("Line %d: Expected number, got '%s'", linecount, tok.GetTokenName()))
-			continue
+		//Get relevant stack
+		cnts := &v.squares
+		if tok == token.CurlyEnd {
+			cnts = &v.curlies
+		} else if tok == token.FunctionEnd {
+			cnts = &v.anglies
 		}
 
-		//This IS a number
-		lineStart = len(program)
-		program = append(program, toks[0], toks[1])
-		pos := 2
+		//Check if stack is empty
+		if len(*cnts) == 0 {
+			if !v.broken {
+				v.e("Unmatched '%s'", name)
+			}
+			v.success = false
+			return
+		}
 
-		//Operator or newline?
-		for stayIn := true; stayIn; {
-			tok = token.Token(toks[pos])
-			pos++
-			switch tok {
-
-			//Unexpected newline
-			case token.Newline:
-				e(fmt.Sprintf("Line %d: Unexpected end of line", linecount))
-				stayIn = false
-
-			//Lefthand chaining
-			case token.ChainPlus, token.ChainMinus:
-
-				//Read new Token
-				next := token.Token(toks[pos])
-				pos++
-				if next != token.Number {
-					e(fmt.Sprintf("Line %d: Expected number, got '%s'", linecount, next.GetTokenName()))
-					stayIn = false
-					break
-				}
+		//Pop context off stack
+		cnt := []programContext(*cnts)[len(*cnts)-1]
+		*cnts = []programContext(*cnts)[:len(*cnts)-1]
 
-				//Push operand and number into program
-				program = append(program, float64(tok), float64(token.Number), toks[pos])
-				pos++
-				continue
+		//The condition jumps into the else branch, and the end of the true branch jumps past it
+		if isElse {
+			if cnt.isElse {
+				v.e("Unexpected '%s', the condition on line %d already has an else branch", name, cnt.startedLine)
+				*cnts = append(*cnts, cnt)
+				return
+			}
+			v.program = append(v.program, float64(token.Else), 0)
+			v.program[cnt.jumplinedestination] = float64(len(v.program))
+			v.curlies = append(v.curlies, programContext{
+				jumplinedestination: len(v.program) - 1,
+				startedLine:         cnt.startedLine,
+				isElse:              true,
+			})
+			return
+		}
 
-			//No righthand required
-			case token.Decrement, token.Increment, token.PrintChar, token.PrintNumber, token.ReadInput, token.FunctionRun:
+		//Was it a looping bracket?
+		if tok == token.SquareEnd {
+			v.program = append(v.program, float64(token.SquareEnd), float64(cnt.jumplinepos))
+			for _, pos := range cnt.breaks {
+				v.program[pos] = float64(len(v.program))
+			}
+		} else if tok == token.FunctionEnd {
+			v.program = append(v.program, float64(token.FunctionEnd))
+		}
+		v.program[cnt.jumplinedestination] = float64(len(v.program))
+		return
+	}
 
-				//Read next Token
-				stayIn = false
-				next := token.Token(toks[pos])
-				pos++
+	//Leave or restart the innermost loop
+	if tok == token.Break || tok == token.Continue {
+		if !expectNewline(tok.GetTokenName()) {
+			return
+		}
 
-				//Was this not a newline?
-				if next != token.Newline {
-					e(fmt.Sprintf("Line %d: Expected newline, got '%s'", linecount, next.GetTokenName()))
-					break
-				}
+		//The loop has to be in the same function, jumping out of one would skip returning from it
+		if len(v.squares) == 0 || v.squares[len(v.squares)-1].functions != len(v.anglies) {
+			if !v.broken {
+				v.e("Unexpected '%s' outside of a loop", tok.GetTokenName())
+			}
+			v.success = false
+			return
+		}
+		loop := &v.squares[len(v.squares)-1]
+
+		//Break jumps past the end bracket, which isn't known yet
+		if tok == token.Break {
+			v.program = append(v.program, float64(tok), 0)
+			loop.breaks = append(loop.breaks, len(v.program)-1)
+		} else {
+			v.program = append(v.program, float64(tok), float64(loop.jumplinepos))
+		}
+		return
+	}
 
-				//Write Token
-				program = append(program, float64(tok))
+	//Return from the function early
+	if tok == token.Return {
+		if !expectNewline(tok.GetTokenName()) {
+			return
+		}
+		if len(v.anglies) == 0 {
+			if !v.broken {
+				v.e("Unexpected '%s' outside of a function", tok.GetTokenName())
+			}
+			v.success = false
+			return
+		}
+		v.program = append(v.program, float64(tok))
+		return
+	}
 
-			//Righthand required
-			case token.Assign:
+	//Then this should be a number
+	if tok != token.Number {
+		v.e("Expected number, found %s", describeToken(tok))
+		return
+	}
+	lefthand, ok := value()
+	if !ok {
+		v.e("Expected number, found end of line")
+		return
+	}
 
-				//Or a function, that works too
-				stayIn = false
-				next := token.Token(toks[pos])
-				if next == token.FunctionStart {
+	//This IS a number, build the instruction separately so errors leave no trace
+	v.lineStart = len(v.program)
+	instruction := []float64{float64(token.Number), lefthand}
+
+	//Chaining, the same for lefthand and righthand.
+	//Returns the token after the chain, and the last number for error messages.
+	readChain := func(last float64) (token.Token, float64, bool) {
+		tok := next()
+		for tok == token.ChainPlus || tok == token.ChainMinus {
+			num, ok := expectNumber(tok.GetTokenName())
+			if !ok {
+				return tok, last, false
+			}
+			instruction = append(instruction, float64(tok), float64(token.Number), num)
+			last = num
+			tok = next()
+		}
+		return tok, last, true
+	}
 
-					//Expect newline
-					pos++
-					next = token.Token(toks[pos])
-					pos++
-					if next != token.Newline {
-						e(fmt.Sprintf("Line %d: Expected newline, got '%s'", linecount, next.GetTokenName()))
-						break
-					}
+	//Lefthand chaining
+	tok, _, chained := readChain(lefthand)
+	if !chained {
+		return
+	}
 
-					//Push operand and pointer onto program stack
-					jpos := len(program) + 3
-					program = append(program, float64(tok), float64(token.Number), float64(jpos), float64(token.FunctionStart), 0)
+	//Operation
+	switch tok {
 
-					//Function shenanigans
-					anglies = append(anglies, programContext{
-						jumplinedestination: len(program) - 1,
-						jumplinepos:         len(program) - 2,
-						startedLine:         linecount,
-					})
+	//Unexpected newline
+	case token.Newline:
+		v.e("Expected operation after number, found end of line")
 
-					//Repeat loop
-					continue
-				}
-				fallthrough
+	//No righthand required
+	case token.Decrement, token.Increment, token.Floor, token.Ceil, token.Round, token.Abs, token.Negate, token.Sqrt, token.PrintChar, token.PrintNumber, token.ReadInput, token.FunctionRun:
+		if !expectNewline(tok.GetTokenName()) {
+			break
+		}
+		v.program = append(v.program, instruction...)
+		v.program = append(v.program, float64(tok))
 
-			//Righthand still required
-			case token.Add, token.Sub, token.Multiply, token.Divide:
+	//Righthand required
+	case token.Assign, token.Add, token.Sub, token.Multiply, token.Divide, token.FloorDivide, token.Modulo, token.Power,
+		token.BitAnd, token.BitOr, token.BitXor, token.ShiftLeft, token.ShiftRight:
 
-				//Read next Token
-				stayIn = false
-				next := token.Token(toks[pos])
-				pos++
+		//Or a function, that works too
+		if tok == token.Assign && pos < len(toks) && token.Token(toks[pos]) == token.FunctionStart {
+			pos++
+			if !expectNewline("<") {
+				break
+			}
 
-				//Expect number
-				if next != token.Number {
-					e(fmt.Sprintf("Line %d: Expected number, got '%s'", linecount, next.GetTokenName()))
-					break
-				}
-				num := toks[pos]
-				pos++
-
-				//Expect newline
-				next = token.Token(toks[pos])
-				pos++
-				if next != token.Newline {
-					e(fmt.Sprintf("Line %d: Expected newline, got '%s'", linecount, next.GetTokenName()))
-					break
-				}
+			//Push operand and pointer onto program stack
+			v.program = append(v.program, instruction...)
+			jpos := len(v.program) + 3
+			v.program = append(v.program, float64(tok), float64(token.Number), float64(jpos), float64(token.FunctionStart), 0)
+
+			//Function shenanigans
+			v.anglies = append(v.anglies, programContext{
+				jumplinedestination: len(v.program) - 1,
+				jumplinepos:         len(v.program) - 2,
+				startedLine:         v.linecount,
+			})
+			break
+		}
 
-				//Push operand and number into program
-				program = append(program, float64(tok), float64(token.Number), num)
-				pos++
+		//Expect number and its chain, then newline
+		num, ok := expectNumber(tok.GetTokenName())
+		if !ok {
+			break
+		}
+		instruction = append(instruction, float64(tok), float64(token.Number), num)
+		after, last, ok := readChain(num)
+		if !ok {
+			break
+		}
+		if after != token.Newline {
+			v.e("Expected newline after '%s', found %s", formatNumber(last), describeToken(after))
+			break
+		}
 
-			//Expect righthand AND start bracket
-			case token.Equals, token.Different, token.GreaterThan, token.GreaterEquals, token.LessThan, token.LessEquals:
+		//Push operand and number into program
+		v.program = append(v.program, instruction...)
 
-				//Read next Token
-				stayIn = false
-				next := token.Token(toks[pos])
-				pos++
+	//Expect righthand AND start bracket
+	case token.Equals, token.Different, token.GreaterThan, token.GreaterEquals, token.LessThan, token.LessEquals:
 
-				//Expect number
-				if next != token.Number {
-					e(fmt.Sprintf("Line %d: Expected number, got '%s'", linecount, next.GetTokenName()))
-					break
-				}
-				num := toks[pos]
-				pos++
+		//Expect number and its chain
+		num, ok := expectNumber(tok.GetTokenName())
+		if !ok {
+			break
+		}
+		instruction = append(instruction, float64(tok), float64(token.Number), num)
+		unchained := len(instruction)
+		bracket, last, ok := readChain(num)
+		if !ok {
+			break
+		}
 
-				//Expect start bracket
-				next = token.Token(toks[pos])
-				pos++
-				if next != token.CurlyStart && next != token.SquareStart {
+		//Expect start bracket
+		if bracket != token.CurlyStart && bracket != token.SquareStart {
+			if len(instruction) == unchained {
+				v.e("Expected start bracket after '%s %s', found %s", tok.GetTokenName(), formatNumber(num), describeToken(bracket))
+			} else {
+				v.e("Expected start bracket after '%s', found %s", formatNumber(last), describeToken(bracket))
+			}
+			break
+		}
+		if !expectNewline(bracket.GetTokenName()) {
+			break
+		}
 
-					//Nope throw an error
-					e(fmt.Sprintf("Line %d: Expected start bracket, got '%s'", linecount, next.GetTokenName()))
-					break
-				}
+		//Push operand and number into program
+		v.program = append(v.program, instruction...)
+		v.program = append(v.program, 0)
 
-				//Push operand and number into program
-				program = append(program, float64(tok), float64(token.Number), num, 0)
-				pos++
+		//Push current context according to bracket type
+		cnt := programContext{
+			jumplinepos:         v.lineStart,
+			jumplinedestination: len(v.program) - 1,
+			startedLine:         v.linecount,
+			functions:           len(v.anglies),
+		}
+		if bracket == token.CurlyStart {
+			v.curlies = append(v.curlies, cnt)
+		} else {
+			v.squares = append(v.squares, cnt)
+		}
 
-				//Push current context according to bracket type
-				if next == token.CurlyStart {
-					curlies = append(curlies, programContext{
-						jumplinepos:         lineStart,
-						jumplinedestination: len(program) - 1,
-						startedLine:         linecount,
-					})
-				} else if next == token.SquareStart {
-					squares = append(squares, programContext{
-						jumplinepos:         lineStart,
-						jumplinedestination: len(program) - 1,
-						startedLine:         linecount,
-					})
-				}
+	//What on earth did you send me?
+	default:
+		v.e("Expected operation, found %s", describeToken(tok))
+	}
+}
 
-			//What on earth did you send me?
-			default:
-				e(fmt.Sprintf("Line %d: Expected operation, found '%s'", linecount, tok.GetTokenName()))
-				stayIn = false
-			}
-		}
+//Mark the final line and check for unclosed brackets
+func (v *validator) finish() {
+	for len(v.lines) < len(v.program) {
+		v.lines = append(v.lines, v.linecount)
 	}
 
 	//Check for unclosed brackets
 	uncloser := func(brackets []programContext, brname string) {
-		for len(brackets) != 0 {
-			brac := brackets[len(brackets)-1]
-			brackets = brackets[:len(brackets)-1]
-			fmt.Printf("unmatched %s bracket at line %d\n", brname, brac.startedLine)
-			success = false
+		for _, brac := range brackets {
+			if !v.broken {
+				v.report(Diagnostic{Line: brac.startedLine, Message: fmt.Sprintf("Unmatched %s bracket", brname)})
+			}
+			v.success = false
 		}
 	}
-	uncloser(curlies, "condition")
-	uncloser(squares, "looping")
-	uncloser(anglies, "function")
-
-	//We done :)
-	close(errors)
-	return program, success
+	uncloser(v.curlies, "condition")
+	uncloser(v.squares, "looping")
+	uncloser(v.anglies, "function")
+	if v.broken {
+		v.success = false
+	}
 }
 
-//Error logging function
-func logErrors(errors <-chan error) {
-	for err := range errors {
-		fmt.Println(err)
+//Describe a token for error messages
+func describeToken(tok token.Token) string {
+	if tok == token.Newline {
+		return "end of line"
 	}
+	return "'" + tok.GetTokenName() + "'"
+}
+
+//Format a number for error messages
+func formatNumber(num float64) string {
+	return strconv.FormatFloat(num, 'g', -1, 64)
 }
 
 //Grab token
-func readToken(text string, pos *int, line int) (token.Token, float64, error) {
+func readToken(text string, pos *int, line int) (token.Token, float64, *Diagnostic) {
 
 	//Read a "word"
 	word, done := readWord(text, pos)
+	start := *pos - len(word)
 	if done {
 		return token.Newline, 0, nil
 	}
@@ -444,6 +674,18 @@ func readToken(text string, pos *int, line int) (token.Token, float64, error) {
 		return token.Decrement, 0, nil
 	case "++":
 		return token.Increment, 0, nil
+	case "_":
+		return token.Floor, 0, nil
+	case "^":
+		return token.Ceil, 0, nil
+	case "~":
+		return token.Round, 0, nil
+	case "||":
+		return token.Abs, 0, nil
+	case "+-":
+		return token.Negate, 0, nil
+	case "_/":
+		return token.Sqrt, 0, nil
 	case "+=":
 		return token.Add, 0, nil
 	case "-=":
@@ -452,6 +694,22 @@ func readToken(text string, pos *int, line int) (token.Token, float64, error) {
 		return token.Multiply, 0, nil
 	case "/=":
 		return token.Divide, 0, nil
+	case "\\=":
+		return token.FloorDivide, 0, nil
+	case "%=":
+		return token.Modulo, 0, nil
+	case "^=":
+		return token.Power, 0, nil
+	case "&=":
+		return token.BitAnd, 0, nil
+	case "|=":
+		return token.BitOr, 0, nil
+	case "~=":
+		return token.BitXor, 0, nil
+	case "<<=":
+		return token.ShiftLeft, 0, nil
+	case ">>=":
+		return token.ShiftRight, 0, nil
 
 	//IO
 	case "\"":
@@ -484,6 +742,10 @@ func readToken(text string, pos *int, line int) (token.Token, float64, error) {
 		return token.SquareStart, 0, nil
 	case "]":
 		return token.SquareEnd, 0, nil
+	case ">]":
+		return token.Break, 0, nil
+	case "[<":
+		return token.Continue, 0, nil
 
 	//Others
 	case "=":
@@ -500,10 +762,18 @@ func readToken(text string, pos *int, line int) (token.Token, float64, error) {
 		return token.FunctionEnd, 0, nil
 	case "()":
 		return token.FunctionRun, 0, nil
+	case ">>":
+		return token.Return, 0, nil
 
 	//Default
 	default:
-		return token.Invalid, 0, fmt.Errorf("line %d: unknown operation: '%s'", line, word)
+		return token.Invalid, 0, &Diagnostic{
+			Line:    line,
+			Column:  utf8.RuneCountInString(text[:start]) + 1,
+			Word:    word,
+			Message: fmt.Sprintf("Unknown operation '%s'", word),
+			Source:  text,
+		}
 	}
 }
 
@@ -513,12 +783,11 @@ func readWord(text string, pos *int) (string, bool) {
 	if char == 0 {
 		return "", true
 	}
-	output := string(char)
+	start := *pos - 1
 
-	//Handle this case
-	if char == '-' {
+	//A minus sign directly before a number is part of it
+	if char == '-' && *pos < len(text) && isNumberChar(text[*pos]) {
 		char = getNextChar(text, pos)
-		output += string(char)
 	}
 
 	switch char {
@@ -528,12 +797,11 @@ func readWord(text string, pos *int) (string, bool) {
 		for {
 			switch char = getNextChar(text, pos); char {
 			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9', ',', '.':
-				output += string(char)
 			case 0:
-				return output, false
+				return text[start:*pos], false
 			default:
 				*pos--
-				return output, false
+				return text[start:*pos], false
 			}
 		}
 
@@ -545,9 +813,7 @@ func readWord(text string, pos *int) (string, bool) {
 				if char != 0 {
 					*pos--
 				}
-				return output, false
-			default:
-				output += string(char)
+				return text[start:*pos], false
 			}
 		}
 	}
@@ -576,6 +842,11 @@ func getNextChar(text string, pos *int) byte {
 	return char
 }
 
+//Can the given character be part of a number?
+func isNumberChar(char byte) bool {
+	return (char >= '0' && char <= '9') || char == ',' || char == '.'
+}
+
 //Is the given character whitespace or not?
 func isWhitespace(char byte) bool {
 
@@ -0,0 +1,566 @@
+package parser
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"numskull/token"
+)
+
+func TestReadWord(t *testing.T) {
+	tests := []struct {
+		text  string
+		words []string
+	}{
+		{"", nil},
+		{"   \t ", nil},
+		{"5", []string{"5"}},
+		{"  12.5 ", []string{"12.5"}},
+		{"-5", []string{"-5"}},
+		{"-0,5", []string{"-0,5"}},
+		{"5++", []string{"5", "++"}},
+		{"5--", []string{"5", "--"}},
+		{"10 = 60", []string{"10", "=", "60"}},
+		{"7.56 += 7", []string{"7.56", "+=", "7"}},
+		{"0+1+3 ?! -1 [", []string{"0", "+", "1", "+", "3", "?!", "-1", "["}},
+		{"1 ?<= 2 {", []string{"1", "?<=", "2", "{"}},
+		{"99()", []string{"99", "()"}},
+		{"-60\"", []string{"-60", "\""}},
+		{"5.5 - -7", []string{"5.5", "-", "-7"}},
+		{"5 - 3", []string{"5", "-", "3"}},
+		{"5 -= -3", []string{"5", "-=", "-3"}},
+		{"-", []string{"-"}},
+		{"5 -", []string{"5", "-"}},
+		{"-.5", []string{"-.5"}},
+	}
+
+	for _, test := range tests {
+		pos := 0
+		var words []string
+		for i := 0; i < 100; i++ {
+			word, done := readWord(test.text, &pos)
+			if done {
+				break
+			}
+			words = append(words, word)
+		}
+		if !reflect.DeepEqual(words, test.words) {
+			t.Errorf("readWord(%q) = %q, want %q", test.text, words, test.words)
+		}
+	}
+}
+
+func TestReadToken(t *testing.T) {
+	tests := []struct {
+		word    string
+		tok     token.Token
+		num     float64
+		wantErr bool
+	}{
+		{"", token.Newline, 0, false},
+		{"5", token.Number, 5, false},
+		{"-2.5", token.Number, -2.5, false},
+		{"--", token.Decrement, 0, false},
+		{"++", token.Increment, 0, false},
+		{"+=", token.Add, 0, false},
+		{"-=", token.Sub, 0, false},
+		{"*=", token.Multiply, 0, false},
+		{"/=", token.Divide, 0, false},
+		{"\\=", token.FloorDivide, 0, false},
+		{"%=", token.Modulo, 0, false},
+		{"^=", token.Power, 0, false},
+		{"&=", token.BitAnd, 0, false},
+		{"|=", token.BitOr, 0, false},
+		{"~=", token.BitXor, 0, false},
+		{"<<=", token.ShiftLeft, 0, false},
+		{">>=", token.ShiftRight, 0, false},
+		{"_", token.Floor, 0, false},
+		{"^", token.Ceil, 0, false},
+		{"~", token.Round, 0, false},
+		{"||", token.Abs, 0, false},
+		{"+-", token.Negate, 0, false},
+		{"_/", token.Sqrt, 0, false},
+		{"\"", token.ReadInput, 0, false},
+		{"!", token.PrintNumber, 0, false},
+		{"#", token.PrintChar, 0, false},
+		{"?=", token.Equals, 0, false},
+		{"?!", token.Different, 0, false},
+		{"?>", token.GreaterThan, 0, false},
+		{"?>=", token.GreaterEquals, 0, false},
+		{"?<", token.LessThan, 0, false},
+		{"?<=", token.LessEquals, 0, false},
+		{"{", token.CurlyStart, 0, false},
+		{"}", token.CurlyEnd, 0, false},
+		{"[", token.SquareStart, 0, false},
+		{"]", token.SquareEnd, 0, false},
+		{">]", token.Break, 0, false},
+		{"[<", token.Continue, 0, false},
+		{">>", token.Return, 0, false},
+		{"=", token.Assign, 0, false},
+		{"+", token.ChainPlus, 0, false},
+		{"-", token.ChainMinus, 0, false},
+		{"<", token.FunctionStart, 0, false},
+		{">", token.FunctionEnd, 0, false},
+		{"()", token.FunctionRun, 0, false},
+		{"?", token.Invalid, 0, true},
+		{"=>", token.Invalid, 0, true},
+		{"a", token.Invalid, 0, true},
+	}
+
+	for _, test := range tests {
+		pos := 0
+		tok, num, err := readToken(test.word, &pos, 1)
+		if (err != nil) != test.wantErr {
+			t.Errorf("readToken(%q) error = %v, want error %v", test.word, err, test.wantErr)
+		}
+		if tok != test.tok || num != test.num {
+			t.Errorf("readToken(%q) = %s %v, want %s %v", test.word, tok.GetTokenName(), num, test.tok.GetTokenName(), test.num)
+		}
+	}
+}
+
+//Token shorthands for building expected programs
+const (
+	tNum = float64(token.Number)
+	tNl  = float64(token.Newline)
+)
+
+func TestValidator(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   [][]float64
+		program []float64
+		ok      bool
+	}{
+		{
+			name:    "empty",
+			lines:   nil,
+			program: []float64{},
+			ok:      true,
+		},
+		{
+			name:    "increment",
+			lines:   [][]float64{{tNum, 5, float64(token.Increment), tNl}},
+			program: []float64{tNum, 5, float64(token.Increment)},
+			ok:      true,
+		},
+		{
+			name:    "assign",
+			lines:   [][]float64{{tNum, 10, float64(token.Assign), tNum, 60, tNl}},
+			program: []float64{tNum, 10, float64(token.Assign), tNum, 60},
+			ok:      true,
+		},
+		{
+			name:    "chained lefthand",
+			lines:   [][]float64{{tNum, 6, float64(token.ChainPlus), tNum, 1, float64(token.PrintNumber), tNl}},
+			program: []float64{tNum, 6, float64(token.ChainPlus), tNum, 1, float64(token.PrintNumber)},
+			ok:      true,
+		},
+		{
+			name:    "chained righthand",
+			lines:   [][]float64{{tNum, 1, float64(token.Assign), tNum, 0, float64(token.ChainPlus), tNum, 2, float64(token.ChainMinus), tNum, 3, tNl}},
+			program: []float64{tNum, 1, float64(token.Assign), tNum, 0, float64(token.ChainPlus), tNum, 2, float64(token.ChainMinus), tNum, 3},
+			ok:      true,
+		},
+		{
+			name:    "chained comparison",
+			lines:   [][]float64{{tNum, 1, float64(token.Equals), tNum, 0, float64(token.ChainPlus), tNum, 2, float64(token.CurlyStart), tNl}, {float64(token.CurlyEnd), tNl}},
+			program: []float64{tNum, 1, float64(token.Equals), tNum, 0, float64(token.ChainPlus), tNum, 2, 9},
+			ok:      true,
+		},
+		{
+			name: "condition",
+			lines: [][]float64{
+				{tNum, 1, float64(token.Equals), tNum, 2, float64(token.CurlyStart), tNl},
+				{tNum, 1, float64(token.PrintNumber), tNl},
+				{float64(token.CurlyEnd), tNl},
+			},
+			program: []float64{tNum, 1, float64(token.Equals), tNum, 2, 9, tNum, 1, float64(token.PrintNumber)},
+			ok:      true,
+		},
+		{
+			name: "break and continue",
+			lines: [][]float64{
+				{tNum, 1, float64(token.LessThan), tNum, 2, float64(token.SquareStart), tNl},
+				{float64(token.Continue), tNl},
+				{float64(token.Break), tNl},
+				{float64(token.SquareEnd), tNl},
+			},
+			program: []float64{tNum, 1, float64(token.LessThan), tNum, 2, 12, float64(token.Continue), 0, float64(token.Break), 12, float64(token.SquareEnd), 0},
+			ok:      true,
+		},
+		{
+			name: "return",
+			lines: [][]float64{
+				{tNum, 1, float64(token.Assign), float64(token.FunctionStart), tNl},
+				{float64(token.Return), tNl},
+				{float64(token.FunctionEnd), tNl},
+			},
+			program: []float64{tNum, 1, float64(token.Assign), tNum, 5, float64(token.FunctionStart), 9, float64(token.Return), float64(token.FunctionEnd)},
+			ok:      true,
+		},
+		{
+			name: "condition with else",
+			lines: [][]float64{
+				{tNum, 1, float64(token.Equals), tNum, 2, float64(token.CurlyStart), tNl},
+				{tNum, 1, float64(token.PrintNumber), tNl},
+				{float64(token.CurlyEnd), float64(token.CurlyStart), tNl},
+				{tNum, 2, float64(token.PrintNumber), tNl},
+				{float64(token.CurlyEnd), tNl},
+			},
+			program: []float64{tNum, 1, float64(token.Equals), tNum, 2, 11, tNum, 1, float64(token.PrintNumber), float64(token.Else), 14, tNum, 2, float64(token.PrintNumber)},
+			ok:      true,
+		},
+		{
+			name: "loop",
+			lines: [][]float64{
+				{tNum, 1, float64(token.LessThan), tNum, 2, float64(token.SquareStart), tNl},
+				{tNum, 1, float64(token.Increment), tNl},
+				{float64(token.SquareEnd), tNl},
+			},
+			program: []float64{tNum, 1, float64(token.LessThan), tNum, 2, 11, tNum, 1, float64(token.Increment), float64(token.SquareEnd), 0},
+			ok:      true,
+		},
+		{
+			name: "function",
+			lines: [][]float64{
+				{tNum, 1, float64(token.Assign), float64(token.FunctionStart), tNl},
+				{float64(token.FunctionEnd), tNl},
+			},
+			program: []float64{tNum, 1, float64(token.Assign), tNum, 5, float64(token.FunctionStart), 8, float64(token.FunctionEnd)},
+			ok:      true,
+		},
+		{name: "lone number", lines: [][]float64{{tNum, 5, tNl}}, ok: false},
+		{name: "missing righthand", lines: [][]float64{{tNum, 5, float64(token.Add), tNl}}, ok: false},
+		{name: "missing chain operand", lines: [][]float64{{tNum, 5, float64(token.ChainPlus), tNl}}, ok: false},
+		{name: "missing bracket", lines: [][]float64{{tNum, 5, float64(token.Equals), tNum, 3, tNl}}, ok: false},
+		{name: "missing comparison operand", lines: [][]float64{{tNum, 5, float64(token.Equals), tNl}}, ok: false},
+		{name: "unmatched end", lines: [][]float64{{float64(token.CurlyEnd), tNl}}, ok: false},
+		{name: "unclosed bracket", lines: [][]float64{{tNum, 1, float64(token.Equals), tNum, 2, float64(token.CurlyStart), tNl}}, ok: false},
+		{name: "trailing token", lines: [][]float64{{tNum, 5, float64(token.Increment), tNum, 3, tNl}}, ok: false},
+		{name: "bracket then more", lines: [][]float64{{float64(token.SquareEnd), tNum, 3, tNl}}, ok: false},
+		{name: "starts with operation", lines: [][]float64{{float64(token.Assign), tNl}}, ok: false},
+	}
+
+	for _, test := range tests {
+		program, lines, ok, _ := validate(test.lines)
+		if ok != test.ok {
+			t.Errorf("%s: ok = %v, want %v", test.name, ok, test.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if !reflect.DeepEqual(program, test.program) {
+			t.Errorf("%s: program = %v, want %v", test.name, program, test.program)
+		}
+		if len(lines) != len(program) {
+			t.Errorf("%s: %d line entries for %d program values", test.name, len(lines), len(program))
+		}
+	}
+}
+
+//Run the validator on the given lines, and collect its errors
+func validate(lines [][]float64) ([]float64, []int, bool, []string) {
+	messages := []string{}
+	v := newValidator(func(d Diagnostic) {
+		messages = append(messages, d.Error())
+	})
+	for _, line := range lines {
+		v.addLine(line)
+	}
+	v.finish()
+	return v.program, v.lines, v.success, messages
+}
+
+func TestValidatorDiagnostics(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines [][]float64
+		want  []string
+	}{
+		{"lone curly", [][]float64{{float64(token.CurlyEnd)}}, []string{"Line 1: Unmatched '}'"}},
+		{"lone else", [][]float64{{float64(token.CurlyEnd), float64(token.CurlyStart), tNl}}, []string{"Line 1: Unmatched '} {'"}},
+		{"else then number", [][]float64{{float64(token.CurlyEnd), float64(token.CurlyStart), tNum, 3, tNl}}, []string{"Line 1: Expected newline after '} {', found 'number'"}},
+		{"second else", [][]float64{
+			{tNum, 1, float64(token.Equals), tNum, 2, float64(token.CurlyStart), tNl},
+			{float64(token.CurlyEnd), float64(token.CurlyStart), tNl},
+			{float64(token.CurlyEnd), float64(token.CurlyStart), tNl},
+			{float64(token.CurlyEnd), tNl},
+		}, []string{"Line 3: Unexpected '} {', the condition on line 1 already has an else branch"}},
+		{"break outside loop", [][]float64{{float64(token.Break), tNl}}, []string{"Line 1: Unexpected '>]' outside of a loop"}},
+		{"continue then number", [][]float64{{float64(token.Continue), tNum, 3, tNl}}, []string{"Line 1: Expected newline after '[<', found 'number'"}},
+		{"break out of function", [][]float64{
+			{tNum, 1, float64(token.LessThan), tNum, 2, float64(token.SquareStart), tNl},
+			{tNum, 3, float64(token.Assign), float64(token.FunctionStart), tNl},
+			{float64(token.Break), tNl},
+			{float64(token.FunctionEnd), tNl},
+			{float64(token.SquareEnd), tNl},
+		}, []string{"Line 3: Unexpected '>]' outside of a loop"}},
+		{"return outside function", [][]float64{{float64(token.Return), tNl}}, []string{"Line 1: Unexpected '>>' outside of a function"}},
+		{"return then number", [][]float64{{float64(token.Return), tNum, 3, tNl}}, []string{"Line 1: Expected newline after '>>', found 'number'"}},
+		{"curly then number", [][]float64{{float64(token.CurlyEnd), tNum, 3, tNl}}, []string{"Line 1: Expected newline after '}', found 'number'"}},
+		{"number without value", [][]float64{{tNum}}, []string{"Line 1: Expected number, found end of line"}},
+		{"number at end", [][]float64{{tNum, 5}}, []string{"Line 1: Expected operation after number, found end of line"}},
+		{"chain at end", [][]float64{{tNum, 5, float64(token.ChainPlus)}}, []string{"Line 1: Expected number after '+', found end of line"}},
+		{"chain without value", [][]float64{{tNum, 5, float64(token.ChainMinus), tNum}}, []string{"Line 1: Expected number after '-', found end of line"}},
+		{"chain to operation", [][]float64{{tNum, 5, float64(token.ChainPlus), float64(token.Increment), tNl}}, []string{"Line 1: Expected number after '+', found '++'"}},
+		{"add at end", [][]float64{{tNum, 5, float64(token.Add)}}, []string{"Line 1: Expected number after '+=', found end of line"}},
+		{"assign then more", [][]float64{{tNum, 5, float64(token.Assign), tNum, 3, tNum, 4, tNl}}, []string{"Line 1: Expected newline after '3', found 'number'"}},
+		{"righthand chain at end", [][]float64{{tNum, 5, float64(token.Assign), tNum, 3, float64(token.ChainPlus)}}, []string{"Line 1: Expected number after '+', found end of line"}},
+		{"righthand chain then more", [][]float64{{tNum, 5, float64(token.Sub), tNum, 3, float64(token.ChainMinus), tNum, 4, float64(token.Increment), tNl}}, []string{"Line 1: Expected newline after '4', found '++'"}},
+		{"chained comparison without bracket", [][]float64{{tNum, 5, float64(token.Equals), tNum, 3, float64(token.ChainPlus), tNum, 4, tNl}}, []string{"Line 1: Expected start bracket after '4', found end of line"}},
+		{"function then more", [][]float64{{tNum, 5, float64(token.Assign), float64(token.FunctionStart), tNum, 4, tNl}}, []string{"Line 1: Expected newline after '<', found 'number'"}},
+		{"increment then more", [][]float64{{tNum, 5, float64(token.Increment), float64(token.Increment)}}, []string{"Line 1: Expected newline after '++', found '++'"}},
+		{"comparison at end", [][]float64{{tNum, 5, float64(token.Equals)}}, []string{"Line 1: Expected number after '?=', found end of line"}},
+		{"comparison without bracket", [][]float64{{tNum, 5, float64(token.Equals), tNum, 3}}, []string{"Line 1: Expected start bracket after '?= 3', found end of line"}},
+		{"comparison wrong bracket", [][]float64{{tNum, 5, float64(token.Equals), tNum, 3, float64(token.CurlyEnd), tNl}}, []string{"Line 1: Expected start bracket after '?= 3', found '}'"}},
+		{"bracket then more", [][]float64{{tNum, 5, float64(token.Equals), tNum, 3, float64(token.CurlyStart), tNum, 1, tNl}}, []string{"Line 1: Expected newline after '{', found 'number'"}},
+		{"invalid operation", [][]float64{{tNum, 5, float64(token.Invalid), tNl}}, []string{"Line 1: Expected operation, found 'invalid'"}},
+		{"starts with operation", [][]float64{{float64(token.Assign), tNl}}, []string{"Line 1: Expected number, found '='"}},
+		{
+			name: "brackets after tokenizer error",
+			lines: [][]float64{
+				{float64(token.Invalid)},
+				{float64(token.CurlyEnd), tNl},
+				{tNum, 1, float64(token.Equals), tNum, 2, float64(token.SquareStart), tNl},
+				{tNum, 1, float64(token.Assign), tNl},
+			},
+			want: []string{"Line 4: Expected number after '=', found end of line"},
+		},
+		{
+			name: "unclosed brackets",
+			lines: [][]float64{
+				{tNum, 1, float64(token.Equals), tNum, 2, float64(token.CurlyStart), tNl},
+				{tNum, 1, float64(token.Equals), tNum, 2, float64(token.SquareStart), tNl},
+			},
+			want: []string{"Line 1: Unmatched condition bracket", "Line 2: Unmatched looping bracket"},
+		},
+	}
+
+	for _, test := range tests {
+		_, _, ok, messages := validate(test.lines)
+		if ok {
+			t.Errorf("%s: validated without errors", test.name)
+			continue
+		}
+		if !reflect.DeepEqual(messages, test.want) {
+			t.Errorf("%s: errors = %q, want %q", test.name, messages, test.want)
+		}
+	}
+}
+
+func TestTokenizeLine(t *testing.T) {
+	got := [][]float64{}
+	positions := [][2]int{}
+	for i, line := range []string{"1 ?= abc {", "\t1 ?? 2   x", "1++"} {
+		toks, errs := tokenizeLine(line, i+1)
+		got = append(got, toks)
+		for _, d := range errs {
+			positions = append(positions, [2]int{d.Line, d.Column})
+		}
+	}
+
+	//Broken lines are replaced by a single Invalid token
+	want := [][]float64{
+		{float64(token.Invalid)},
+		{float64(token.Invalid)},
+		{tNum, 1, float64(token.Increment), tNl},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("tokens = %v, want %v", got, want)
+	}
+
+	//Every unknown word is reported
+	if !reflect.DeepEqual(positions, [][2]int{{1, 6}, {2, 4}, {2, 11}}) {
+		t.Errorf("error positions = %v", positions)
+	}
+}
+
+func TestDiagnosticCaret(t *testing.T) {
+	d := &Diagnostic{Line: 2, Column: 4, Word: "??", Message: "Unknown operation '??'", Source: "\t1 ?? 2  "}
+	want := "Line 2, column 4: Unknown operation '??'\n\t\t1 ?? 2\n\t\t  ^"
+	if d.Error() != want {
+		t.Errorf("Error() = %q, want %q", d.Error(), want)
+	}
+}
+
+func TestSeparateLines(t *testing.T) {
+
+	//Block comments are blanked out, not removed
+	got := []string{}
+	separateLines("1 /* a\tb */ 1!\n/* x\ny */ 2!", func(line string) {
+		got = append(got, line)
+	}, nil)
+	want := []string{"1     \t     1!", "    ", "     2!"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lines = %q, want %q", got, want)
+	}
+}
+
+func TestParse(t *testing.T) {
+	src := "//test: text\n1 = 10\n1 ?= 2 {\n1 ?? 2\n1 +=\n}\n5 ?= 3 [\n1!"
+	prog, diagnostics := Parse([]byte(src))
+
+	//Errors come in source order, with bracket errors suppressed after an unknown word
+	got := make([]string, len(diagnostics))
+	for i, d := range diagnostics {
+		got[i] = fmt.Sprintf("%d:%d %s", d.Line, d.Column, d.Message)
+	}
+	want := []string{
+		"4:3 Unknown operation '??'",
+		"5:0 Expected number after '+=', found end of line",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diagnostics = %q, want %q", got, want)
+	}
+	if !reflect.DeepEqual(prog.Directives, []Directive{{Line: 1, Text: "text"}}) {
+		t.Errorf("directives = %+v", prog.Directives)
+	}
+
+	//Unclosed brackets are found last, but still come in source order
+	_, diagnostics = Parse([]byte("1 ?= 1 [\n2 ?= 2 {\n5 +\n6 ?="))
+	got = make([]string, len(diagnostics))
+	for i, d := range diagnostics {
+		got[i] = fmt.Sprintf("%d:%d %s", d.Line, d.Column, d.Message)
+	}
+	want = []string{
+		"1:0 Unmatched looping bracket",
+		"2:0 Unmatched condition bracket",
+		"3:0 Expected number after '+', found end of line",
+		"4:0 Expected number after '?=', found end of line",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diagnostics = %q, want %q", got, want)
+	}
+
+	//A valid program
+	prog, diagnostics = Parse([]byte("1 = 10\n1!"))
+	if len(diagnostics) != 0 {
+		t.Fatalf("unexpected diagnostics: %v", diagnostics)
+	}
+	wantCode := []float64{tNum, 1, float64(token.Assign), tNum, 10, tNum, 1, float64(token.PrintNumber)}
+	if !reflect.DeepEqual(prog.Code, wantCode) || !reflect.DeepEqual(prog.Lines, []int{1, 1, 1, 1, 1, 2, 2, 2}) {
+		t.Errorf("program = %v, lines %v", prog.Code, prog.Lines)
+	}
+}
+
+func TestParseLines(t *testing.T) {
+	src := "//comment\n1 = 10\n\n/* multi\nline */ 1!\n"
+	prog, diagnostics := Parse([]byte(src))
+	if len(diagnostics) != 0 {
+		t.Fatalf("unexpected diagnostics: %v", diagnostics)
+	}
+	want := []int{2, 2, 2, 2, 2, 5, 5, 5}
+	if !reflect.DeepEqual(prog.Lines, want) {
+		t.Errorf("lines = %v, want %v (program %v)", prog.Lines, want, prog.Code)
+	}
+}
+
+func TestTestDirectives(t *testing.T) {
+	src := "//test: text\n1\" //test: input \"3\" expect \"3\"\n/*\n//test: hidden\n*/\n// test: spaced\n1!"
+	got := TestDirectives(src)
+	want := []Directive{
+		{Line: 1, Text: "text"},
+		{Line: 2, Text: "input \"3\" expect \"3\""},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("TestDirectives = %+v, want %+v", got, want)
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"",
+		"}",
+		"]",
+		">",
+		"5 +",
+		"5 -",
+		"-",
+		"5 ?=",
+		"5 ?= 3",
+		"5 ?= 3 {",
+		"5 = <",
+		"1 = 10\n1 ?> 5 [\n1!\n1--\n]\n",
+		"1 = <\n2()\n>\n1()\n",
+		"1 ?= 1 [\n1 ?! 4 {\n]\n}\n",
+		"1/*a\nb*/!//c",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, src string) {
+
+		//Parsing is quadratic in line length, keep inputs small
+		if len(src) > 4096 {
+			return
+		}
+		prog, diagnostics := Parse([]byte(src))
+
+		//Diagnostics are sorted by position
+		for i := 1; i < len(diagnostics); i++ {
+			if diagnostics[i].Line < diagnostics[i-1].Line {
+				t.Fatalf("diagnostics out of order: %v", diagnostics)
+			}
+		}
+		if len(diagnostics) != 0 {
+			return
+		}
+
+		//Every value of a valid program has a line
+		if len(prog.Lines) != len(prog.Code) {
+			t.Fatalf("%d line entries for %d program values", len(prog.Lines), len(prog.Code))
+		}
+	})
+}
+
+func TestFormat(t *testing.T) {
+	src := "//Count\n1=10   //Start\n1 ?> 0 [\n  1 !\n1 _/\n0+1 - 3 + -2 -= 4\n1 ?= 5 {\n32 #\n5 = <\n5()\n>\n}\n/* kept */  1--  \n]\n\n\n"
+	want := "//Count\n1 = 10 //Start\n1 ?> 0 [\n    1!\n    1_/\n    0+1 - 3 + -2 -= 4\n    1 ?= 5 {\n        32#\n        5 = <\n            5()\n        >\n    }\n/* kept */  1--\n]\n"
+	got, diagnostics := Format([]byte(src))
+	if len(diagnostics) != 0 {
+		t.Fatalf("unexpected diagnostics: %v", diagnostics)
+	}
+	if string(got) != want {
+		t.Errorf("Format =\n%s\nwant\n%s", got, want)
+	}
+
+	//Formatting again changes nothing, and the program is the same
+	again, _ := Format(got)
+	if string(again) != string(got) {
+		t.Errorf("Format is not stable:\n%s", again)
+	}
+	before, _ := Parse([]byte(src))
+	after, _ := Parse(got)
+	if !reflect.DeepEqual(before.Code, after.Code) {
+		t.Errorf("formatting changed the program")
+	}
+
+	//Comments keep their column, moved along with the indent
+	got, _ = Format([]byte("1 ?= 1 {\n1!   //Print\n    1++ //Count\n}"))
+	if string(got) != "1 ?= 1 {\n    1!   //Print\n    1++ //Count\n}\n" {
+		t.Errorf("Format = %q", got)
+	}
+
+	//Programs with errors aren't formatted
+	if got, diagnostics := Format([]byte("1 ?? 2")); got != nil || len(diagnostics) != 1 {
+		t.Errorf("Format = %q, %v", got, diagnostics)
+	}
+}
+
+func TestOpenBrackets(t *testing.T) {
+	tests := map[string]int{
+		"1 = 5":                 0,
+		"1 ?= 1 {":              1,
+		"1 = <\n1 ?= 1 [\n]":    1,
+		"1 ?= 1 {\n}\n":         0,
+		"1 ?= 1 { //[\n/* < */": 1,
+	}
+	for src, want := range tests {
+		if got := OpenBrackets([]byte(src)); got != want {
+			t.Errorf("OpenBrackets(%q) = %d, want %d", src, got, want)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"sort"
+)
+
+//Field numbers from pprof's profile.proto
+const (
+	pprofSampleType  = 1
+	pprofSample      = 2
+	pprofLocation    = 4
+	pprofFunction    = 5
+	pprofStringTable = 6
+	pprofPeriodType  = 11
+	pprofPeriod      = 12
+
+	pprofValueTypeType = 1
+	pprofValueTypeUnit = 2
+
+	pprofSampleLocation = 1
+	pprofSampleValue    = 2
+
+	pprofLocationId   = 1
+	pprofLocationLine = 4
+
+	pprofLineFunction = 1
+	pprofLineLine     = 2
+
+	pprofFunctionId        = 1
+	pprofFunctionName      = 2
+	pprofFunctionSystem    = 3
+	pprofFunctionFilename  = 4
+	pprofFunctionStartLine = 5
+)
+
+//Minimal protocol buffer encoder
+type protoBuffer struct {
+	data []byte
+}
+
+//Write a variable length integer
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		b.data = append(b.data, byte(v)|0x80)
+		v >>= 7
+	}
+	b.data = append(b.data, byte(v))
+}
+
+//Write a field key
+func (b *protoBuffer) key(field int, wiretype int) {
+	b.varint(uint64(field)<<3 | uint64(wiretype))
+}
+
+//Write an integer field
+func (b *protoBuffer) uintField(field int, v uint64) {
+	b.key(field, 0)
+	b.varint(v)
+}
+
+//Write a length delimited field
+func (b *protoBuffer) bytesField(field int, data []byte) {
+	b.key(field, 2)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+//Write a packed list of integers
+func (b *protoBuffer) packedField(field int, values []uint64) {
+	var packed protoBuffer
+	for _, v := range values {
+		packed.varint(v)
+	}
+	b.bytesField(field, packed.data)
+}
+
+//Deduplicated pprof string table
+type pprofStrings struct {
+	list  []string
+	index map[string]uint64
+}
+
+//Get index of string, adding it if needed
+func (st *pprofStrings) get(s string) uint64 {
+	if i, exists := st.index[s]; exists {
+		return i
+	}
+	i := uint64(len(st.list))
+	st.list = append(st.list, s)
+	st.index[s] = i
+	return i
+}
+
+//Export profile in the format used by "go tool pprof"
+func writePprofProfile(out io.Writer) error {
+	var prof protoBuffer
+	strs := &pprofStrings{index: make(map[string]uint64)}
+	strs.get("")
+
+	//Value type, steps counted per sample
+	var valueType protoBuffer
+	valueType.uintField(pprofValueTypeType, strs.get("steps"))
+	valueType.uintField(pprofValueTypeUnit, strs.get("count"))
+	prof.bytesField(pprofSampleType, valueType.data)
+
+	//Functions by entry point
+	functionIds := make(map[int]uint64)
+	var functions protoBuffer
+	functionId := func(entry int) uint64 {
+		if id, exists := functionIds[entry]; exists {
+			return id
+		}
+		id := uint64(len(functionIds) + 1)
+		functionIds[entry] = id
+
+		//Encode function
+		var fun protoBuffer
+		name := strs.get(functionName(entry))
+		fun.uintField(pprofFunctionId, id)
+		fun.uintField(pprofFunctionName, name)
+		fun.uintField(pprofFunctionSystem, name)
+		fun.uintField(pprofFunctionFilename, strs.get(programPath))
+		fun.uintField(pprofFunctionStartLine, uint64(lineAt(entry)))
+		functions.bytesField(pprofFunction, fun.data)
+		return id
+	}
+
+	//Locations by function and line
+	type locationKey struct {
+		entry int
+		line  int
+	}
+	locationIds := make(map[locationKey]uint64)
+	var locations protoBuffer
+	locationId := func(entry int, line int) uint64 {
+		key := locationKey{entry, line}
+		if id, exists := locationIds[key]; exists {
+			return id
+		}
+		id := uint64(len(locationIds) + 1)
+		locationIds[key] = id
+
+		//Encode location
+		var ln protoBuffer
+		ln.uintField(pprofLineFunction, functionId(entry))
+		ln.uintField(pprofLineLine, uint64(line))
+		var loc protoBuffer
+		loc.uintField(pprofLocationId, id)
+		loc.bytesField(pprofLocationLine, ln.data)
+		locations.bytesField(pprofLocation, loc.data)
+		return id
+	}
+
+	//One sample per line in every call context
+	profileRoot.walk(func(node *profileNode) {
+
+		//Call sites leading to this node, innermost first
+		callers := make([]uint64, 0, 8)
+		for n := node; n.parent != nil; n = n.parent {
+			callers = append(callers, locationId(n.parent.entry, lineAt(n.callSite)))
+		}
+
+		//Sort lines, so output doesn't depend on map order
+		lines := make([]int, 0, len(node.lines))
+		for line := range node.lines {
+			lines = append(lines, line)
+		}
+		sort.Ints(lines)
+
+		for _, line := range lines {
+			stack := append([]uint64{locationId(node.entry, line)}, callers...)
+			var sample protoBuffer
+			sample.packedField(pprofSampleLocation, stack)
+			sample.packedField(pprofSampleValue, []uint64{uint64(node.lines[line])})
+			prof.bytesField(pprofSample, sample.data)
+		}
+	})
+
+	//Put it all together
+	prof.data = append(prof.data, locations.data...)
+	prof.data = append(prof.data, functions.data...)
+	for _, s := range strs.list {
+		prof.bytesField(pprofStringTable, []byte(s))
+	}
+	prof.bytesField(pprofPeriodType, valueType.data)
+	prof.uintField(pprofPeriod, 1)
+
+	//pprof files are gzip compressed
+	zw := gzip.NewWriter(out)
+	if _, err := zw.Write(prof.data); err != nil {
+		return err
+	}
+	return zw.Close()
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+//Profile formats
+const (
+	profileText  string = "text"
+	profilePprof string = "pprof"
+)
+
+//A function call context in the profile.
+//Every distinct chain of calls gets its own node.
+type profileNode struct {
+	parent   *profileNode
+	callSite int
+	entry    int
+	children map[profileKey]*profileNode
+	lines    map[int]int64
+}
+
+//Identifies a call from one place to one function
+type profileKey struct {
+	callSite int
+	entry    int
+}
+
+//Profiler state
+var profileRoot *profileNode
+var profileCurrent *profileNode
+
+//Create an empty profile
+func profileReset() {
+	profileRoot = &profileNode{
+		callSite: -1,
+		entry:    -1,
+		children: make(map[profileKey]*profileNode),
+		lines:    make(map[int]int64),
+	}
+	profileCurrent = profileRoot
+}
+
+//Count one executed instruction
+func profileStep(pos int) {
+	profileCurrent.lines[lineAt(pos)]++
+}
+
+//Enter a function
+func profileCall(callSite int, entry int) {
+
+	//Calls from the same place to the same function share a node
+	key := profileKey{callSite, entry}
+	child, exists := profileCurrent.children[key]
+	if !exists {
+		child = &profileNode{
+			parent:   profileCurrent,
+			callSite: callSite,
+			entry:    entry,
+			children: make(map[profileKey]*profileNode),
+			lines:    make(map[int]int64),
+		}
+		profileCurrent.children[key] = child
+	}
+	profileCurrent = child
+}
+
+//Leave a function
+func profileReturn() {
+	if profileCurrent.parent != nil {
+		profileCurrent = profileCurrent.parent
+	}
+}
+
+//Total steps spent in a node and everything it called
+func (node *profileNode) total() int64 {
+	return node.totals(nil)
+}
+
+//Like total, but also saves the total of every node below it in sums, children first
+func (node *profileNode) totals(sums map[*profileNode]int64) int64 {
+	var sum int64
+	for _, count := range node.lines {
+		sum += count
+	}
+	for _, child := range node.children {
+		sum += child.totals(sums)
+	}
+	if sums != nil {
+		sums[node] = sum
+	}
+	return sum
+}
+
+//Visit every node in the profile, parents before children
+func (node *profileNode) walk(visit func(node *profileNode)) {
+	visit(node)
+
+	//Sort children, so output doesn't depend on map order
+	keys := make([]profileKey, 0, len(node.children))
+	for key := range node.children {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].callSite != keys[j].callSite {
+			return keys[i].callSite < keys[j].callSite
+		}
+		return keys[i].entry < keys[j].entry
+	})
+	for _, key := range keys {
+		node.children[key].walk(visit)
+	}
+}
+
+//Steps spent per function
+type functionProfile struct {
+	entry     int
+	self      int64
+	inclusive int64
+}
+
+//Sum up steps per source line and per function
+func profileSummary() (map[int]int64, map[int]*functionProfile) {
+	lines := make(map[int]int64)
+	functions := make(map[int]*functionProfile)
+
+	//Total of every node, worked out once
+	totals := make(map[*profileNode]int64)
+	profileRoot.totals(totals)
+
+	//Functions currently being visited, so recursion is only counted once
+	active := make(map[int]int)
+
+	var visit func(node *profileNode)
+	visit = func(node *profileNode) {
+		fun, exists := functions[node.entry]
+		if !exists {
+			fun = &functionProfile{entry: node.entry}
+			functions[node.entry] = fun
+		}
+
+		//Self time
+		for line, count := range node.lines {
+			lines[line] += count
+			fun.self += count
+		}
+
+		//Inclusive time, only for the outermost call
+		if active[node.entry] == 0 {
+			fun.inclusive += totals[node]
+		}
+
+		//Visit children
+		active[node.entry]++
+		for _, child := range node.children {
+			visit(child)
+		}
+		active[node.entry]--
+	}
+	visit(profileRoot)
+
+	return lines, functions
+}
+
+//Name of a function in reports
+func functionName(entry int) string {
+	if entry < 0 {
+		return "(main)"
+	}
+	return strings.TrimSpace(sourceLine(lineAt(entry)))
+}
+
+//Save the profile to a file in the given format
+func writeProfile(path string, format string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	//Write in the correct format
+	if format == profilePprof {
+		err = writePprofProfile(file)
+	} else {
+		err = writeTextProfile(file)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+//Hot-spot report
+func writeTextProfile(out io.Writer) error {
+	w := bufio.NewWriter(out)
+	lines, functions := profileSummary()
+	total := profileRoot.total()
+
+	//Percentage of all steps
+	percent := func(count int64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(count) * 100 / float64(total)
+	}
+
+	fmt.Fprintf(w, "Numskull profile: %s\n", programPath)
+	fmt.Fprintf(w, "Total steps: %d\n", total)
+
+	//Lines, busiest first
+	lineNumbers := make([]int, 0, len(lines))
+	for line := range lines {
+		lineNumbers = append(lineNumbers, line)
+	}
+	sort.Slice(lineNumbers, func(i, j int) bool {
+		a, b := lineNumbers[i], lineNumbers[j]
+		if lines[a] != lines[b] {
+			return lines[a] > lines[b]
+		}
+		return a < b
+	})
+	fmt.Fprintf(w, "\nLines\n%12s %7s %6s  %s\n", "steps", "%", "line", "source")
+	for _, line := range lineNumbers {
+		fmt.Fprintf(w, "%12d %6.2f%% %6d  %s\n", lines[line], percent(lines[line]), line, strings.TrimSpace(sourceLine(line)))
+	}
+
+	//Functions, most inclusive time first
+	funs := make([]*functionProfile, 0, len(functions))
+	for _, fun := range functions {
+		funs = append(funs, fun)
+	}
+	sort.Slice(funs, func(i, j int) bool {
+		if funs[i].inclusive != funs[j].inclusive {
+			return funs[i].inclusive > funs[j].inclusive
+		}
+		return funs[i].entry < funs[j].entry
+	})
+	fmt.Fprintf(w, "\nFunctions\n%12s %7s %12s %7s %6s  %s\n", "self", "%", "inclusive", "%", "line", "function")
+	for _, fun := range funs {
+		fmt.Fprintf(w, "%12d %6.2f%% %12d %6.2f%% %6d  %s\n",
+			fun.self, percent(fun.self),
+			fun.inclusive, percent(fun.inclusive),
+			lineAt(fun.entry), functionName(fun.entry),
+		)
+	}
+
+	return w.Flush()
+}
+
+//Make sure the given profile format exists
+func validProfileFormat(format string) bool {
+	return format == profileText || format == profilePprof
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"numskull/parser"
+)
+
+//Prompts shown by the REPL
+const (
+	replPrompt   string = "> "
+	replContinue string = "... "
+)
+
+//Entrypoint for "numskull repl"
+func replCommand() *command {
+	cmd := &command{
+		name:    "repl",
+		summary: "Run lines of code as they're typed",
+		details: []string{
+			"Every line runs as soon as it's entered, and memory is kept between lines.",
+			"Lines that open a bracket wait for the bracket to be closed before running.",
+			"Functions keep working after they're defined, like in a program.",
+			"Type :reset to clear memory and forget every line, or :quit to leave.",
+		},
+	}
+	cmd.run = func(args []string) int {
+		if len(args) != 0 {
+			fmt.Fprintln(errorOutput, "Error: repl takes no arguments")
+			return exitUsage
+		}
+		runREPL(stdin, consoleWriter)
+		return exitOK
+	}
+	return cmd
+}
+
+//Read lines and run them, until the end of input or :quit.
+//Prompts and program output go to out, errors go to errorOutput.
+func runREPL(in io.RuneScanner, out io.Writer) {
+	var source strings.Builder
+	pending := ""
+	resetREPL := func() {
+		resetRuntime()
+		source.Reset()
+		program, programLines, sourceLines = nil, nil, nil
+		programPath = "<repl>"
+	}
+	resetREPL()
+
+	//Keep track of unfinished output lines, so the prompt starts on a new line
+	tracker := &lineTracker{w: consoleWriter}
+	consoleWriter = tracker
+	defer func() {
+		consoleWriter = tracker.w
+	}()
+
+	fmt.Fprintln(out, "Numskull", version_language, "- type :quit to leave")
+	for {
+		if pending == "" {
+			fmt.Fprint(out, replPrompt)
+		} else {
+			fmt.Fprint(out, replContinue)
+		}
+		line, err := readLine(in)
+		if err != nil {
+			fmt.Fprintln(out)
+			return
+		}
+
+		//Commands
+		switch strings.TrimSpace(line) {
+		case ":quit":
+			return
+		case ":reset":
+			resetREPL()
+			pending = ""
+			continue
+		}
+
+		//Wait for brackets to be closed
+		pending += line + "\n"
+		if parser.OpenBrackets([]byte(pending)) > 0 {
+			continue
+		}
+		chunk := pending
+		pending = ""
+
+		//Parse everything so far, so functions and jumps keep their places
+		full := source.String() + chunk
+		parsed, diagnostics := parser.Parse([]byte(full))
+		if len(diagnostics) != 0 {
+			for _, d := range diagnostics {
+				fmt.Fprintln(errorOutput, d.Error())
+			}
+			continue
+		}
+		source.WriteString(chunk)
+		start := len(program)
+		program, programLines = parsed.Code, parsed.Lines
+		sourceLines = strings.Split(full, "\n")
+
+		//Run only the new part
+		err = runProgramAt(program, start)
+		if tracker.open {
+			fmt.Fprintln(out)
+			tracker.open = false
+		}
+		if err != nil {
+			fmt.Fprintln(errorOutput, err.Error())
+		}
+	}
+}
+
+//Read a line, without the newline
+func readLine(in io.RuneScanner) (string, error) {
+	var line strings.Builder
+	for {
+		char, _, err := in.ReadRune()
+		if err != nil {
+			if line.Len() != 0 {
+				return line.String(), nil
+			}
+			return "", err
+		}
+		if char == '\n' {
+			return strings.TrimSuffix(line.String(), "\r"), nil
+		}
+		line.WriteRune(char)
+	}
+}
+
+//Remembers if the last line written wasn't finished
+type lineTracker struct {
+	w    io.Writer
+	open bool
+}
+
+//Write, remembering if the line was left unfinished
+func (t *lineTracker) Write(p []byte) (int, error) {
+	if len(p) != 0 {
+		t.open = p[len(p)-1] != '\n'
+	}
+	return t.w.Write(p)
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"numskull/parser"
+)
+
+//Instructions a test may execute before it fails, so a program that never finishes can't hang the runner
+var testMaxSteps int = 10000000
+
+//A program with golden files next to it, or a "//test:" directive in it
+type goldenTest struct {
+	program    string
+	inputPath  string
+	outputPath string
+	binary     bool
+
+	//Only for directives
+	line     int
+	input    *string
+	expected string
+	err      error
+}
+
+//Entrypoint for "numskull test"
+func testCommand() *command {
+	update := false
+	verbose := false
+
+	cmd := &command{
+		name:    "test",
+		args:    "[path...]",
+		summary: "Run programs and compare their output to golden files",
+		details: []string{
+			"A program.nms is tested when program.out and/or program.in exist.",
+			"program.in is used as the input file, program.out is the expected output.",
+			"Programs can also contain their own tests, using comments like:",
+			"\t//test: input \"3 5\" expect \"8\"",
+			"Input files are read as binary, and input from comments is read as text.",
+			"The comment //test: text or //test: binary picks the input type for the whole program.",
+			"Paths can be programs or directories, which are searched recursively.",
+			"Without any paths, the current directory is searched.",
+			fmt.Sprintf("A test fails once its program has executed %d instructions, so programs that never finish can't hang.", testMaxSteps),
+		},
+		flags: []*flagDef{
+			{name: "update", usage: "Write the actual output to the .out files and comments instead of comparing", set: setTrue(&update)},
+			{name: "verbose", short: "v", usage: "Also list tests that passed", set: setTrue(&verbose)},
+		},
+	}
+	cmd.run = func(paths []string) int {
+		if len(paths) == 0 {
+			paths = append(paths, ".")
+		}
+
+		//Find tests
+		tests := make([]goldenTest, 0, 16)
+		for _, path := range paths {
+			found, err := findTests(path)
+			if err != nil {
+				fmt.Fprintln(errorOutput, "Error searching for tests")
+				fmt.Fprintln(errorOutput, err.Error())
+				return exitError
+			}
+			tests = append(tests, found...)
+		}
+		if len(tests) == 0 {
+			fmt.Println("no tests found")
+			return exitOK
+		}
+
+		//Run them
+		passed, failed := 0, 0
+		for _, test := range tests {
+			if runGoldenTest(test, update, verbose) {
+				passed++
+			} else {
+				failed++
+			}
+		}
+
+		//Summary
+		fmt.Printf("%d passed, %d failed\n", passed, failed)
+		if failed != 0 {
+			return exitError
+		}
+		return exitOK
+	}
+	return cmd
+}
+
+//Find every test in or at path
+func findTests(path string) ([]goldenTest, error) {
+	tests := make([]goldenTest, 0, 16)
+
+	//Search recursively
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(p, ".nms") {
+			return nil
+		}
+
+		//Read directives
+		src, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		mode := ""
+		inline := make([]goldenTest, 0, 4)
+		for _, directive := range parser.TestDirectives(string(src)) {
+			switch directive.Text {
+			case "text", "binary":
+				mode = directive.Text
+				continue
+			}
+
+			//Test case
+			test := goldenTest{program: p, line: directive.Line}
+			test.input, test.expected, test.err = parseTestDirective(directive.Text)
+			inline = append(inline, test)
+		}
+
+		//Input from files is binary by default
+		base := strings.TrimSuffix(p, ".nms")
+		test := goldenTest{program: p, binary: mode != "text"}
+		if fileExists(base + ".in") {
+			test.inputPath = base + ".in"
+		}
+		if test.inputPath != "" || fileExists(base+".out") {
+			test.outputPath = base + ".out"
+			tests = append(tests, test)
+		}
+
+		//Input from comments is text by default
+		for _, test := range inline {
+			test.binary = mode == "binary"
+			tests = append(tests, test)
+		}
+		return nil
+	})
+	return tests, err
+}
+
+//Read a directive like: input "3 5" expect "8"
+func parseTestDirective(text string) (*string, string, error) {
+	var input *string
+	var expected *string
+
+	for text = strings.TrimSpace(text); text != ""; text = strings.TrimSpace(text) {
+
+		//Read keyword
+		word := text
+		if i := strings.IndexAny(text, " \t"); i >= 0 {
+			word = text[:i]
+		}
+		text = strings.TrimSpace(text[len(word):])
+		if word != "input" && word != "expect" {
+			return nil, "", fmt.Errorf("unknown test directive '%s'", word)
+		}
+
+		//Read quoted string
+		quoted, err := strconv.QuotedPrefix(text)
+		if err != nil {
+			return nil, "", fmt.Errorf("expected quoted string after '%s'", word)
+		}
+		value, _ := strconv.Unquote(quoted)
+		text = text[len(quoted):]
+
+		//Store it
+		if word == "input" {
+			if input != nil {
+				return nil, "", fmt.Errorf("more than one input")
+			}
+			input = &value
+		} else {
+			if expected != nil {
+				return nil, "", fmt.Errorf("more than one expect")
+			}
+			expected = &value
+		}
+	}
+
+	//Expected output is required
+	if expected == nil {
+		return nil, "", fmt.Errorf("missing expect")
+	}
+	return input, *expected, nil
+}
+
+//Does this file exist?
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+//Run one test and report the result
+func runGoldenTest(test goldenTest, update bool, verbose bool) bool {
+	name := test.program
+	if test.line != 0 {
+		name = fmt.Sprintf("%s:%d", test.program, test.line)
+	}
+	fail := func(format string, args ...interface{}) bool {
+		fmt.Printf("FAIL %s\n", name)
+		fmt.Printf("\t"+format+"\n", args...)
+		return false
+	}
+	if test.err != nil {
+		return fail("%s", test.err.Error())
+	}
+
+	//Read program and input
+	src, err := os.ReadFile(test.program)
+	if err != nil {
+		return fail("%s", err.Error())
+	}
+	var raw []byte
+	if test.inputPath != "" {
+		raw, err = os.ReadFile(test.inputPath)
+		if err != nil {
+			return fail("%s", err.Error())
+		}
+	}
+	if test.input != nil {
+		raw = []byte(*test.input)
+	}
+
+	//Run it
+	output, err := runTestProgram(test.program, src, raw, test.binary)
+	if err != nil {
+		return fail("%s", err.Error())
+	}
+
+	//Update expected output
+	if update {
+		if test.line != 0 {
+			err = updateTestDirective(test, string(output))
+		} else {
+			err = os.WriteFile(test.outputPath, output, 0644)
+		}
+		if err != nil {
+			return fail("%s", err.Error())
+		}
+		fmt.Printf("updated %s\n", name)
+		return true
+	}
+
+	//Get expected output
+	var expected []byte
+	if test.line != 0 {
+		expected = []byte(test.expected)
+	} else {
+		expected, err = os.ReadFile(test.outputPath)
+		if err != nil {
+			return fail("%s (run with -update to create it)", err.Error())
+		}
+	}
+
+	//Compare
+	if !bytes.Equal(expected, output) {
+		fmt.Printf("FAIL %s\n", name)
+		fmt.Print(outputDiff(string(expected), string(output)))
+		return false
+	}
+
+	if verbose {
+		fmt.Printf("ok   %s\n", name)
+	}
+	return true
+}
+
+//Rewrite a "//test:" comment with new expected output
+func updateTestDirective(test goldenTest, output string) error {
+	raw, err := os.ReadFile(test.program)
+	if err != nil {
+		return err
+	}
+
+	//Find the comment
+	lines := strings.Split(string(raw), "\n")
+	if test.line > len(lines) {
+		return fmt.Errorf("line %d not found", test.line)
+	}
+	line := lines[test.line-1]
+	start := strings.Index(line, "//"+parser.TestDirectivePrefix)
+	if start < 0 {
+		return fmt.Errorf("test directive not found on line %d", test.line)
+	}
+
+	//Replace it, keeping any carriage return
+	directive := "//" + parser.TestDirectivePrefix + " "
+	if test.input != nil {
+		directive += "input " + strconv.Quote(*test.input) + " "
+	}
+	directive += "expect " + strconv.Quote(output)
+	if strings.HasSuffix(line, "\r") {
+		directive += "\r"
+	}
+	lines[test.line-1] = line[:start] + directive
+	return os.WriteFile(test.program, []byte(strings.Join(lines, "\n")), 0644)
+}
+
+//Parse and run a program with the given input, and capture its output
+func runTestProgram(path string, src []byte, raw []byte, binary bool) ([]byte, error) {
+
+	//Parse program
+	parsed, diagnostics := parser.Parse(src)
+	if len(diagnostics) != 0 {
+		return nil, fmt.Errorf("program contains errors\n%s", diagnostics[0].Error())
+	}
+	code, lines := parsed.Code, parsed.Lines
+
+	//Convert input
+	var numbers []float64
+	if binary || len(raw) == 0 {
+		numbers = binaryInput(raw)
+	} else {
+		var err error
+		numbers, err = textInput(raw)
+		if err != nil {
+			return nil, fmt.Errorf("error when converting input: %s", err.Error())
+		}
+	}
+
+	//Swap in test settings, and restore them afterwards
+	var output bytes.Buffer
+	oldProgram, oldLines, oldPath, oldSource := program, programLines, programPath, sourceLines
+	oldInput, oldFromFile := input, readFromFile
+	oldConsole, oldWriter, oldToFile := consoleOutput, consoleWriter, writeToFile
+	oldTracing, oldProfiling, oldCovering := tracing, profiling, covering
+	oldSteps := maxSteps
+	defer func() {
+		program, programLines, programPath, sourceLines = oldProgram, oldLines, oldPath, oldSource
+		input, readFromFile = oldInput, oldFromFile
+		consoleOutput, consoleWriter, writeToFile = oldConsole, oldWriter, oldToFile
+		tracing, profiling, covering = oldTracing, oldProfiling, oldCovering
+		maxSteps = oldSteps
+	}()
+	program, programLines, programPath = code, lines, path
+	sourceLines = strings.Split(string(src), "\n")
+	input, readFromFile = numbers, true
+	consoleOutput, consoleWriter, writeToFile = true, &output, false
+	tracing, profiling, covering = false, false, false
+	if maxSteps == 0 {
+		maxSteps = testMaxSteps
+	}
+	resetRuntime()
+
+	//Run program
+	err := runProgram(program)
+	if err != nil {
+		return output.Bytes(), fmt.Errorf("runtime error: %s", err.Error())
+	}
+	return output.Bytes(), nil
+}
+
+//Line by line difference between expected and actual output
+func outputDiff(expected string, got string) string {
+	a := splitLines(expected)
+	b := splitLines(got)
+
+	//Longest common subsequence, too big outputs are just listed
+	var out strings.Builder
+	if len(a)*len(b) > 1<<22 {
+		out.WriteString("\t--- expected\n")
+		for _, line := range a {
+			out.WriteString("\t-" + strings.TrimSuffix(line, "\n") + "\n")
+		}
+		out.WriteString("\t+++ got\n")
+		for _, line := range b {
+			out.WriteString("\t+" + strings.TrimSuffix(line, "\n") + "\n")
+		}
+		return out.String()
+	}
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	//Write differences
+	out.WriteString("\t--- expected\n\t+++ got\n")
+	show := func(prefix string, line string) {
+		text := strings.TrimSuffix(line, "\n")
+		if text == line {
+			text += "  (no newline at end)"
+		}
+		out.WriteString("\t" + prefix + text + "\n")
+	}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			show(" ", a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			show("-", a[i])
+			i++
+		default:
+			show("+", b[j])
+			j++
+		}
+	}
+	return out.String()
+}
+
+//Split text into lines, keeping the newlines
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
@@ -32,6 +32,24 @@ const (
 	FunctionStart
 	FunctionEnd
 	FunctionRun
+	Modulo
+	Power
+	FloorDivide
+	Floor
+	Ceil
+	Round
+	Abs
+	Negate
+	Sqrt
+	BitAnd
+	BitOr
+	BitXor
+	ShiftLeft
+	ShiftRight
+	Else
+	Break
+	Continue
+	Return
 )
 
 //Returns the name of the given token as a string
@@ -47,10 +65,38 @@ func (tok Token) GetTokenName() string {
 		return "*="
 	case Divide:
 		return "/="
+	case FloorDivide:
+		return "\\="
+	case Modulo:
+		return "%="
+	case Power:
+		return "^="
 	case Increment:
 		return "++"
 	case Decrement:
 		return "--"
+	case BitAnd:
+		return "&="
+	case BitOr:
+		return "|="
+	case BitXor:
+		return "~="
+	case ShiftLeft:
+		return "<<="
+	case ShiftRight:
+		return ">>="
+	case Floor:
+		return "_"
+	case Ceil:
+		return "^"
+	case Round:
+		return "~"
+	case Abs:
+		return "||"
+	case Negate:
+		return "+-"
+	case Sqrt:
+		return "_/"
 	case ChainPlus:
 		return "+"
 	case ChainMinus:
@@ -82,6 +128,14 @@ func (tok Token) GetTokenName() string {
 		return "{"
 	case CurlyEnd:
 		return "}"
+	case Else:
+		return "} {"
+	case Break:
+		return ">]"
+	case Continue:
+		return "[<"
+	case Return:
+		return ">>"
 	case SquareStart:
 		return "["
 	case SquareEnd:
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+//Trace formats
+const (
+	traceText string = "text"
+	traceJSON string = "json"
+)
+
+//A memory cell and the value it held
+type traceValue struct {
+	address float64
+	value   float64
+}
+
+//Everything that happened during one instruction
+type traceEvent struct {
+	offset     int
+	line       int
+	op         string
+	hasAddress bool
+	address    float64
+	reads      []traceValue
+	writes     []traceValue
+	branch     string
+	jump       int
+}
+
+//Start tracing a new instruction
+func (ev *traceEvent) reset(offset int, line int) {
+	ev.offset = offset
+	ev.line = line
+	ev.op = ""
+	ev.hasAddress = false
+	ev.address = 0
+	ev.reads = ev.reads[:0]
+	ev.writes = ev.writes[:0]
+	ev.branch = ""
+	ev.jump = -1
+}
+
+//Write event as a single line in the chosen format
+func (ev *traceEvent) write(w *bufio.Writer, format string) {
+	if format == traceJSON {
+		ev.writeJSON(w)
+	} else {
+		ev.writeText(w)
+	}
+}
+
+//Human readable trace line
+func (ev *traceEvent) writeText(w *bufio.Writer) {
+	fmt.Fprintf(w, "%6d  line %-4d %-3s", ev.offset, ev.line, ev.op)
+	if ev.hasAddress {
+		fmt.Fprintf(w, "  @%s", formatTraceNumber(ev.address))
+	}
+
+	//Values read and written
+	if len(ev.reads) != 0 {
+		w.WriteString("  read")
+		for _, r := range ev.reads {
+			fmt.Fprintf(w, " [%s]=%s", formatTraceNumber(r.address), formatTraceNumber(r.value))
+		}
+	}
+	if len(ev.writes) != 0 {
+		w.WriteString("  write")
+		for _, wr := range ev.writes {
+			fmt.Fprintf(w, " [%s]=%s", formatTraceNumber(wr.address), formatTraceNumber(wr.value))
+		}
+	}
+
+	//Control flow
+	if ev.branch != "" {
+		w.WriteString("  " + ev.branch)
+	}
+	if ev.jump >= 0 {
+		fmt.Fprintf(w, "  -> %d", ev.jump)
+	}
+	w.WriteByte('\n')
+}
+
+//JSON Lines trace line
+func (ev *traceEvent) writeJSON(w *bufio.Writer) {
+	fmt.Fprintf(w, `{"offset":%d,"line":%d,"op":%s`, ev.offset, ev.line, strconv.Quote(ev.op))
+	if ev.hasAddress {
+		w.WriteString(`,"address":` + jsonTraceNumber(ev.address))
+	}
+
+	//Values read and written
+	writeValues := func(name string, values []traceValue) {
+		if len(values) == 0 {
+			return
+		}
+		w.WriteString(`,"` + name + `":[`)
+		for i, v := range values {
+			if i != 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(`{"address":` + jsonTraceNumber(v.address) + `,"value":` + jsonTraceNumber(v.value) + `}`)
+		}
+		w.WriteByte(']')
+	}
+	writeValues("reads", ev.reads)
+	writeValues("writes", ev.writes)
+
+	//Control flow
+	if ev.branch != "" {
+		w.WriteString(`,"branch":` + strconv.Quote(ev.branch))
+	}
+	if ev.jump >= 0 {
+		fmt.Fprintf(w, `,"jump":%d`, ev.jump)
+	}
+	w.WriteString("}\n")
+}
+
+//Format number the same way on every platform
+func formatTraceNumber(num float64) string {
+	return strconv.FormatFloat(num, 'g', -1, 64)
+}
+
+//JSON has no NaN or infinity, so those are written as strings
+func jsonTraceNumber(num float64) string {
+	if math.IsNaN(num) || math.IsInf(num, 0) {
+		return strconv.Quote(formatTraceNumber(num))
+	}
+	return formatTraceNumber(num)
+}
+
+//Make sure the given trace format exists
+func validTraceFormat(format string) bool {
+	return format == traceText || format == traceJSON
+}
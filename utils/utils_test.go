@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"math"
+	"testing"
+)
+
+func TestBytesliceToNumber(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    float64
+		wantErr bool
+	}{
+		{"0", 0, false},
+		{"42", 42, false},
+		{"-7", -7, false},
+		{"3.25", 3.25, false},
+		{"-0.5", -0.5, false},
+		{".5", 0.5, false},
+		{"007", 7, false},
+		{"", 0, true},
+		{"-", 0, true},
+		{"5.", 0, true},
+		{"5,", 0, true},
+		{"1.2.3", 0, true},
+		{"abc", 0, true},
+		{"--5", 0, true},
+	}
+
+	for _, test := range tests {
+		got, err := BytesliceToNumber([]byte(test.in))
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("BytesliceToNumber(%q) = %v, want error", test.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("BytesliceToNumber(%q) returned error: %v", test.in, err)
+			continue
+		}
+		if got != test.want || math.Signbit(got) != math.Signbit(test.want) {
+			t.Errorf("BytesliceToNumber(%q) = %v, want %v", test.in, got, test.want)
+		}
+	}
+}